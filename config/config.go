@@ -50,6 +50,67 @@ func buildOptions(base string) {
 	ConfigOption("P2P.AdvertisePort", 7947)
 	ConfigOption("P2P.MessageVerifyOverride", false)
 
+	// Where accepted state messages are saved, empty to disable
+	ConfigOption("P2P.StateJournal", filepath.Join(base, "p2p_state.journal"))
+
+	// Who is allowed to update the state
+	ConfigOption("P2P.MembershipProvider", "pool")        // One of "pool", "allowlist" or "open"
+	ConfigOption("P2P.MembershipAllowlist", "")           // File of allowed addresses for the allowlist provider
+	ConfigOption("P2P.MembershipCacheTTL", "5m")          // How long a pool member is trusted before checking again
+	ConfigOption("P2P.MembershipNegativeCacheTTL", "30s") // How long a non member is remembered
+	ConfigOption("P2P.MembershipCacheSize", 10000)        // Most addresses the membership cache holds
+
+	// Node liveness
+	ConfigOption("P2P.Liveness.StaleAfter", "5m")    // Nodes without a new message for this long get no content links
+	ConfigOption("P2P.Liveness.ExpireAfter", "168h") // Nodes without a new message for this long are removed, 0 to keep forever
+
+	// How long signed deletes are remembered so older updates can't undo them
+	ConfigOption("P2P.Tombstones.Retention", "168h")
+
+	// Bounds on signed message timestamps, 0 disables either check
+	ConfigOption("P2P.Clock.MaxSkew", "5m")      // How far in the future a message can be dated
+	ConfigOption("P2P.Clock.MaxMessageAge", "0") // How old a message can be
+
+	// How state updates are relayed between peers
+	ConfigOption("P2P.Gossip.Fanout", 4)            // Random peers each update is sent to, 0 sends to every peer
+	ConfigOption("P2P.Gossip.MaxHops", 6)           // How many times an update is relayed
+	ConfigOption("P2P.Gossip.SeenCacheSize", 10000) // How many recent update hashes are remembered
+
+	// Workers that verify received state messages, and how many messages of
+	// each priority can wait for them
+	ConfigOption("P2P.Verify.Workers", 4)
+	ConfigOption("P2P.Verify.QueueSize", 1024)
+
+	// Misbehaving peers are banned once their score reaches the threshold,
+	// scores go down over time. Off by default, offenses are scored against the
+	// sender a message claims so a peer could get another one banned.
+	ConfigOption("P2P.PeerScoring.BanThreshold", 0) // 0 to never ban
+	ConfigOption("P2P.PeerScoring.BanDuration", "1h")
+	ConfigOption("P2P.PeerScoring.DecayPerMinute", 10)
+	ConfigOption("P2P.PeerScoring.MaxMessageSize", 16*1024*1024) // In bytes, 0 for no limit
+	ConfigOption("P2P.PeerScoring.MaxSyncRequestsPerMinute", 10) // 0 for no limit
+
+	// How seeds are retried when joining the network, the backoff doubles
+	// after every failed attempt
+	ConfigOption("P2P.Join.Attempts", 3)
+	ConfigOption("P2P.Join.Timeout", "5s")
+	ConfigOption("P2P.Join.Backoff", "1s")
+
+	// Default strategy for choosing content links: random, round_robin,
+	// least_recent, freshest or weighted (by the node's capacity field)
+	ConfigOption("P2P.ContentLinks.Strategy", "random")
+
+	// Automatic heartbeats, the address fields are only sent when set
+	ConfigOption("P2P.Heartbeat.Enabled", false)
+	ConfigOption("P2P.Heartbeat.Interval", "1m")
+	ConfigOption("P2P.Heartbeat.IPAddress", "")
+	ConfigOption("P2P.Heartbeat.HTTPPort", 0)
+	ConfigOption("P2P.Heartbeat.ContentPort", 0)
+
+	// Extra state fields on top of the built in ones, maps of field name to kind
+	ConfigOption("P2P.State.Node", map[string]interface{}{})
+	ConfigOption("P2P.State.Pool", map[string]interface{}{})
+
 	// Blockchain options
 	ConfigOption("Blockchain.Provider", "https://mainnet.infura.io/v3/1d3545f907ff4598893997c522e46676")
 	ConfigOption("Blockchain.MarketAddress", "0x27a9390283236f836a0b3c8dfdbed2ed854322fc")
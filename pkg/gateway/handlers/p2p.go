@@ -1,9 +1,13 @@
 package handlers
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/buger/jsonparser"
 	"github.com/gorilla/mux"
@@ -65,12 +69,12 @@ func getSignedMessageFromBody(w http.ResponseWriter, r *http.Request) *signature
 }
 
 // Helper to get fields from the json body and verify the signature
-func verifyBody(w http.ResponseWriter, r *http.Request) (bool, *signature.SignedMessage) {
+func verifyBody(p *peer.Peer, w http.ResponseWriter, r *http.Request) (bool, *signature.SignedMessage) {
 	parsed := getSignedMessageFromBody(w, r)
 	if parsed == nil {
 		return false, nil
 	}
-	verified := parsed.IsInPoolAndVerified()
+	verified := p.VerifyMessage(parsed)
 
 	return verified, parsed
 }
@@ -82,24 +86,62 @@ func getContentListFromBody(w http.ResponseWriter, r *http.Request) []string {
 		handlers.ErrorHandler(w, r, "Error decoding body", err, http.StatusBadRequest)
 		return nil
 	}
+	return contentListFromBytes(body)
+}
+
+// contentListFromBytes reads the content list from a body that is either the
+// list itself or an object with the list under `content`
+func contentListFromBytes(body []byte) []string {
+	var keys []string
+	if !isJSONArray(body) {
+		keys = []string{"content"}
+	}
+
 	s := make([]string, 0)
 	// Get all content file names passed in
 	jsonparser.ArrayEach(body, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
 		s = append(s, string(value))
-	}, "content")
+	}, keys...)
 
 	return s
 }
 
+func isJSONArray(body []byte) bool {
+	_, dataType, _, _ := jsonparser.Get(body)
+	return dataType == jsonparser.Array
+}
+
+// Gets the content list and link options from a content links request
+func getContentLinksRequestFromBody(w http.ResponseWriter, r *http.Request) ([]string, peer.ContentLinkOptions, bool) {
+	opts := peer.ContentLinkOptions{}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handlers.ErrorHandler(w, r, "Error decoding body", err, http.StatusBadRequest)
+		return nil, opts, false
+	}
+
+	// A bare list of files uses the default options
+	if !isJSONArray(body) {
+		opts.IncludeStale, _ = jsonparser.GetBoolean(body, "include_stale")
+		opts.Strategy, _ = jsonparser.GetString(body, "strategy")
+		maxLinks, _ := jsonparser.GetInt(body, "max_links")
+		opts.MaxLinks = int(maxLinks)
+	}
+
+	return contentListFromBytes(body), opts, true
+}
+
 // VerifySignedMessageHandler verifies the incoming message with takes the form
 // of:
 // {"message": "b64string", "hash": "b64string", "signature": "b64string", "address": ""}
-func VerifySignedMessageHandler(w http.ResponseWriter, r *http.Request) {
-	v, _ := verifyBody(w, r)
-	if v {
-		handlers.ResponseHandler(w, r, "Message is verified", true, nil, true, nil)
-	} else {
-		handlers.ResponseHandler(w, r, "Message is not verified", true, nil, false, nil)
+func VerifySignedMessageHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, _ := verifyBody(p, w, r)
+		if v {
+			handlers.ResponseHandler(w, r, "Message is verified", true, nil, true, nil)
+		} else {
+			handlers.ResponseHandler(w, r, "Message is not verified", true, nil, false, nil)
+		}
 	}
 }
 
@@ -133,7 +175,11 @@ func CreateSignedMessageHandler(ga *blockchain.GladiusAccountManager) func(w htt
 	}
 }
 
-func SetStateDebugHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
+// RebuildStateHandler rebuilds the state from a signature list (like the
+// output of /state/signatures) or a full state. Every message is verified and
+// applied like an update from the network, the response says how many were
+// accepted and why the others were rejected.
+func RebuildStateHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -141,15 +187,13 @@ func SetStateDebugHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Requ
 			return
 		}
 
-		toUpdate, _, _, err := jsonparser.Get(body, "state")
+		sms, err := state.ParseSignedMessages(body)
 		if err != nil {
-			handlers.ErrorHandler(w, r, "Could not find `state` in body", err, http.StatusBadRequest)
+			handlers.ErrorHandler(w, r, "Could not find signed messages in body", err, http.StatusBadRequest)
 			return
 		}
-		s, _ := state.ParseNetworkState(toUpdate)
-		p.SetState(s)
 
-		handlers.ResponseHandler(w, r, "Updated state", true, nil, s, nil)
+		handlers.ResponseHandler(w, r, "Rebuilt state from signed messages", true, nil, p.RebuildState(sms), nil)
 	}
 }
 
@@ -158,13 +202,16 @@ func SetStateDebugHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Requ
 // network has a consistent state
 func PushStateMessageHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		v, sm := verifyBody(w, r)
+		v, sm := verifyBody(p, w, r)
 		if v {
-			err := p.UpdateAndPushState(sm)
+			result, err := p.UpdateAndPushState(sm)
 			if err != nil {
-				handlers.ErrorHandler(w, r, "Error updating state", err, http.StatusBadRequest)
+				// Include the outcome of each field so the caller can see what was wrong
+				w.WriteHeader(http.StatusBadRequest)
+				errString := err.Error()
+				handlers.ResponseHandler(w, r, "Error updating state", false, &errString, result, nil)
 			} else {
-				handlers.ResponseHandler(w, r, "Message was pushed. This does not necessarily mean that the message was recieved by peers.", true, nil, true, nil)
+				handlers.ResponseHandler(w, r, "Message was pushed. This does not necessarily mean that the message was recieved by peers.", true, nil, result, nil)
 			}
 		} else {
 			if sm != nil {
@@ -174,37 +221,49 @@ func PushStateMessageHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.R
 	}
 }
 
-func getIntroductionDataFromBody(w http.ResponseWriter, r *http.Request) (ip string) {
+// getSeedsFromBody reads the seed addresses to join from either a `seeds` list
+// or a single `ip`
+func getSeedsFromBody(r *http.Request) ([]string, error) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		handlers.ErrorHandler(w, r, "Error decoding body", err, http.StatusBadRequest)
-		return ""
+		return nil, err
 	}
 
-	ip, err = jsonparser.GetString(body, "ip")
-	if err != nil {
-		handlers.ErrorHandler(w, r, "Could not find `ip` in body", err, http.StatusBadRequest)
-		return ""
+	seeds := make([]string, 0)
+	jsonparser.ArrayEach(body, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		if dataType == jsonparser.String && len(value) > 0 {
+			seeds = append(seeds, string(value))
+		}
+	}, "seeds")
+	if ip, err := jsonparser.GetString(body, "ip"); err == nil && ip != "" {
+		seeds = append(seeds, ip)
 	}
 
-	return ip
+	if len(seeds) == 0 {
+		return nil, errors.New("could not find `seeds` or `ip` in body")
+	}
+	return seeds, nil
 }
 
-// JoinHandler takes in an IP and tries to join it's cluster
+// JoinHandler takes in a list of seed addresses and tries to join their
+// cluster, returning what happened with each seed
 func JoinHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ip := getIntroductionDataFromBody(w, r)
-		if ip != "" {
-			err := p.Join([]string{ip})
-			if err != nil {
-				handlers.ErrorHandler(w, r, "Couldn't join network", err, http.StatusBadRequest)
-				return
-			}
-			handlers.ResponseHandler(w, r, "Requested to join pool", true, nil, nil, nil)
+		seeds, err := getSeedsFromBody(r)
+		if err != nil {
+			handlers.ErrorHandler(w, r, "Seed addresses can't be empty", err, http.StatusBadRequest)
 			return
 		}
-		handlers.ErrorHandler(w, r, "IP can't be empty", nil, http.StatusBadRequest)
 
+		result, err := p.Join(seeds)
+		if err != nil {
+			// Include the outcome of each seed so the caller can see what failed
+			w.WriteHeader(http.StatusBadRequest)
+			errString := err.Error()
+			handlers.ResponseHandler(w, r, "Couldn't join network", false, &errString, result, nil)
+			return
+		}
+		handlers.ResponseHandler(w, r, "Joined pool", true, nil, result, nil)
 	}
 }
 
@@ -218,9 +277,75 @@ func LeaveHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
 // GetFullStateHandler gets the current state the node has access to.
 func GetFullStateHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		state := p.GetState()
-		handlers.ResponseHandler(w, r, "Got full state", true, nil, state, nil)
+		handlers.ResponseHandler(w, r, "Got full state", true, nil, p.GetState().Snapshot(), nil)
+	}
+}
+
+// StateEventsHandler streams every accepted field change as a server sent
+// event. The stream can be filtered with the `node` and `field` query
+// parameters, which can be repeated or comma separated.
+func StateEventsHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			handlers.ErrorHandler(w, r, "Streaming is not supported", errors.New("response can't be flushed"), http.StatusInternalServerError)
+			return
+		}
+
+		nodes := queryFilter(r, "node")
+		fields := queryFilter(r, "field")
+
+		sub := p.GetState().Subscribe(256)
+		defer p.GetState().Unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(30 * time.Second)
+		defer keepAlive.Stop()
+
+		var dropped uint64
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case change := <-sub.C:
+				if (len(nodes) > 0 && !nodes[strings.ToLower(change.Node)]) ||
+					(len(fields) > 0 && !fields[strings.ToLower(change.Field)]) {
+					continue
+				}
+				b, err := json.Marshal(change)
+				if err != nil {
+					continue
+				}
+				// Let the client know it missed something and should refetch
+				if d := sub.Dropped(); d != dropped {
+					fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", d-dropped)
+					dropped = d
+				}
+				fmt.Fprintf(w, "event: field_change\ndata: %s\n\n", b)
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// queryFilter returns the set of lowercased values for a query parameter
+func queryFilter(r *http.Request, key string) map[string]bool {
+	filter := make(map[string]bool)
+	for _, values := range r.URL.Query()[key] {
+		for _, v := range strings.Split(values, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				filter[strings.ToLower(v)] = true
+			}
+		}
 	}
+	return filter
 }
 
 // GetNodeStateHandler gets the current state of a specific node
@@ -228,7 +353,7 @@ func GetNodeStateHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Reque
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		na := vars["node_address"]
-		nodeState, exists := p.GetState().NodeDataMap[na]
+		nodeState, exists := p.GetState().Snapshot().NodeDataMap[na]
 		if exists {
 			handlers.ResponseHandler(w, r, "Got state for: "+na, true, nil, nodeState, nil)
 			return
@@ -237,6 +362,87 @@ func GetNodeStateHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+// GetStateSchemaHandler gets the fields the state accepts and the values that
+// are valid for them
+func GetStateSchemaHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handlers.ResponseHandler(w, r, "Got state schema", true, nil, p.GetState().GetSchema(), nil)
+	}
+}
+
+// GetNodeLivenessHandler gets how recently each node in the state was heard
+// from and if it is considered alive
+func GetNodeLivenessHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handlers.ResponseHandler(w, r, "Got node liveness", true, nil, p.GetNodeStatuses(), nil)
+	}
+}
+
+// GetClockSkewHandler gets how far ahead of our clock each signer's messages
+// are, and which signers are consistently skewed
+func GetClockSkewHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handlers.ResponseHandler(w, r, "Got clock skew", true, nil, p.GetState().GetClockSkew(), nil)
+	}
+}
+
+// GetNetworkPeersHandler gets the peers we're connected to, the score of every
+// peer that has misbehaved and which of them are banned. With ?wallets=true
+// connected peers are matched to nodes in the state by their IP address.
+func GetNetworkPeersHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		withWallets := r.URL.Query().Get("wallets") == "true"
+		peers := map[string]interface{}{
+			"connected": p.GetConnectedPeers(withWallets),
+			"scores":    p.GetPeerScores(),
+		}
+		handlers.ResponseHandler(w, r, "Got network peers", true, nil, peers, nil)
+	}
+}
+
+// GetDiscoveredPeersHandler gets the peer addresses other peers have told us
+// about
+func GetDiscoveredPeersHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handlers.ResponseHandler(w, r, "Got discovered peers", true, nil, p.GetDiscoveredPeers(), nil)
+	}
+}
+
+// GetVerifierStatsHandler gets the state message verification queue lengths
+// and counts
+func GetVerifierStatsHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handlers.ResponseHandler(w, r, "Got verification queue stats", true, nil, p.GetVerifierStats(), nil)
+	}
+}
+
+// GetStateFingerprintHandler gets a hash of the local state, two peers with
+// the same fingerprint have the same state
+func GetStateFingerprintHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handlers.ResponseHandler(w, r, "Got state fingerprint", true, nil, map[string]string{"fingerprint": p.GetState().Fingerprint()}, nil)
+	}
+}
+
+// CheckConsistencyHandler asks every known peer for its state fingerprint and
+// reports which ones differ from ours. The wait for replies can be set with
+// the `timeout` query parameter, like "10s".
+func CheckConsistencyHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout := 5 * time.Second
+		if t := r.URL.Query().Get("timeout"); t != "" {
+			var err error
+			timeout, err = time.ParseDuration(t)
+			if err != nil {
+				handlers.ErrorHandler(w, r, "Invalid timeout", err, http.StatusBadRequest)
+				return
+			}
+		}
+
+		handlers.ResponseHandler(w, r, "Checked state consistency with peers", true, nil, p.CheckConsistency(timeout), nil)
+	}
+}
+
 // GetSignatureListHandler gets the list of signatures used to create the current
 // state
 func GetSignatureListHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
@@ -254,11 +460,22 @@ func GetContentNeededHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.R
 	}
 }
 
-// GetContentLinksHandler gets the links to the given list of files from random
-// nodes in the network
+// GetContentLinksHandler gets the links to the given list of files from nodes
+// in the network. The body is either the list of files or an object like
+// {"content": [...], "strategy": "random", "max_links": 3}, which can choose a
+// `strategy` (random, round_robin, least_recent, freshest or weighted), the
+// `max_links` per file and whether to `include_stale` nodes.
 func GetContentLinksHandler(p *peer.Peer) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c := getContentListFromBody(w, r)
-		handlers.ResponseHandler(w, r, "Got needed content links", true, nil, p.GetContentLinks(c), nil)
+		c, opts, ok := getContentLinksRequestFromBody(w, r)
+		if !ok {
+			return
+		}
+		links, err := p.GetContentLinks(c, opts)
+		if err != nil {
+			handlers.ErrorHandler(w, r, "Couldn't get content links", err, http.StatusBadRequest)
+			return
+		}
+		handlers.ResponseHandler(w, r, "Got needed content links", true, nil, links, nil)
 	}
 }
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/peer"
+)
+
+func TestGetContentLinksRequestFromBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		content []string
+		opts    peer.ContentLinkOptions
+	}{
+		{
+			name:    "bare list",
+			body:    `["site/a", "site/b"]`,
+			content: []string{"site/a", "site/b"},
+		},
+		{
+			name:    "object",
+			body:    `{"content": ["site/a", "site/b"], "strategy": "round_robin", "max_links": 2}`,
+			content: []string{"site/a", "site/b"},
+			opts:    peer.ContentLinkOptions{Strategy: "round_robin", MaxLinks: 2},
+		},
+		{
+			name:    "object including stale nodes",
+			body:    `{"content": ["site/a"], "include_stale": true}`,
+			content: []string{"site/a"},
+			opts:    peer.ContentLinkOptions{IncludeStale: true},
+		},
+		{
+			name:    "object without options",
+			body:    `{"content": ["site/a"]}`,
+			content: []string{"site/a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/p2p/state/content_links", strings.NewReader(tt.body))
+			content, opts, ok := getContentLinksRequestFromBody(httptest.NewRecorder(), r)
+			if !ok {
+				t.Fatal("body was rejected")
+			}
+			if !reflect.DeepEqual(content, tt.content) {
+				t.Errorf("expected content %v, got %v", tt.content, content)
+			}
+			if opts != tt.opts {
+				t.Errorf("expected options %+v, got %+v", tt.opts, opts)
+			}
+		})
+	}
+}
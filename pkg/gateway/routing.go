@@ -78,31 +78,45 @@ func (g *Gateway) addRoutes() {
 	// P2P Message Routes
 	p2pRouter.HandleFunc("/message/sign", lhandlers.CreateSignedMessageHandler(g.ga)).
 		Methods(http.MethodPost)
-	p2pRouter.HandleFunc("/message/verify", lhandlers.VerifySignedMessageHandler).
+	p2pRouter.HandleFunc("/message/verify", lhandlers.VerifySignedMessageHandler(peerStruct)).
 		Methods("POST")
 	p2pRouter.HandleFunc("/network/join", lhandlers.JoinHandler(peerStruct)).
 		Methods("POST")
 	p2pRouter.HandleFunc("/network/leave", lhandlers.LeaveHandler(peerStruct)).
 		Methods("POST")
+	p2pRouter.HandleFunc("/network/peers", lhandlers.GetNetworkPeersHandler(peerStruct)).
+		Methods("GET")
+	p2pRouter.HandleFunc("/network/discovery", lhandlers.GetDiscoveredPeersHandler(peerStruct)).
+		Methods("GET")
+	p2pRouter.HandleFunc("/network/consistency", lhandlers.CheckConsistencyHandler(peerStruct)).
+		Methods("GET")
 	p2pRouter.HandleFunc("/state/push_message", lhandlers.PushStateMessageHandler(peerStruct)).
 		Methods("POST")
 	p2pRouter.HandleFunc("/state", lhandlers.GetFullStateHandler(peerStruct)).
 		Methods("GET")
+	p2pRouter.HandleFunc("/state/events", lhandlers.StateEventsHandler(peerStruct)).
+		Methods("GET")
 	p2pRouter.HandleFunc("/state/node/{node_address}", lhandlers.GetNodeStateHandler(peerStruct)).
 		Methods("GET")
+	p2pRouter.HandleFunc("/state/liveness", lhandlers.GetNodeLivenessHandler(peerStruct)).
+		Methods("GET")
+	p2pRouter.HandleFunc("/state/schema", lhandlers.GetStateSchemaHandler(peerStruct)).
+		Methods("GET")
+	p2pRouter.HandleFunc("/state/skew", lhandlers.GetClockSkewHandler(peerStruct)).
+		Methods("GET")
+	p2pRouter.HandleFunc("/state/queue", lhandlers.GetVerifierStatsHandler(peerStruct)).
+		Methods("GET")
 	p2pRouter.HandleFunc("/state/signatures", lhandlers.GetSignatureListHandler(peerStruct)).
 		Methods("GET")
+	p2pRouter.HandleFunc("/state/fingerprint", lhandlers.GetStateFingerprintHandler(peerStruct)).
+		Methods("GET")
+	p2pRouter.HandleFunc("/state/rebuild", lhandlers.RebuildStateHandler(peerStruct)).
+		Methods("POST")
 	p2pRouter.HandleFunc("/state/content_diff", lhandlers.GetContentNeededHandler(peerStruct)).
 		Methods("POST")
 	p2pRouter.HandleFunc("/state/content_links", lhandlers.GetContentLinksHandler(peerStruct)).
 		Methods("POST")
 
-	// Only enable for testing
-	if viper.GetBool("NodeManager.Config.Debug") {
-		p2pRouter.HandleFunc("/state/set_state", lhandlers.SetStateDebugHandler(peerStruct)).
-			Methods("POST")
-	}
-
 	// Blockchain account management endpoints
 	routing.AppendAccountManagementEndpoints(baseRouter)
 
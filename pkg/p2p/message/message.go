@@ -2,6 +2,7 @@ package message
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 )
 
@@ -10,16 +11,37 @@ import (
 type Message struct {
 	Content   *json.RawMessage `json:"content"`
 	Timestamp int64            `json:"timestamp"`
+	Sequence  int64            `json:"sequence,omitempty"`
 }
 
 // New creates a new Message type with fields for timestamp and a json message
 func New(jsonMessage []byte) *Message {
 	h := json.RawMessage(jsonMessage)
-	return &Message{Content: &h, Timestamp: time.Now().Unix()}
+	return &Message{Content: &h, Timestamp: time.Now().Unix(), Sequence: nextSequence()}
 }
 
 func NewBlankMessage() *Message {
-	return &Message{Content: nil, Timestamp: time.Now().Unix()}
+	return &Message{Content: nil, Timestamp: time.Now().Unix(), Sequence: nextSequence()}
+}
+
+var (
+	lastSequence int64
+	sequenceMux  sync.Mutex
+)
+
+// nextSequence returns a number higher than any returned before, so messages
+// signed in the same second can still be ordered. It starts from the clock in
+// nanoseconds so it keeps increasing across restarts.
+func nextSequence() int64 {
+	sequenceMux.Lock()
+	defer sequenceMux.Unlock()
+
+	seq := time.Now().UnixNano()
+	if seq <= lastSequence {
+		seq = lastSequence + 1
+	}
+	lastSequence = seq
+	return seq
 }
 
 // Serialize returns a serialized JSON string that includes the current timestamp
@@ -0,0 +1,121 @@
+package peer
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/gladiusio/legion/network"
+	"github.com/gladiusio/legion/utils"
+)
+
+// fingerprintReply is a state fingerprint received from a peer
+type fingerprintReply struct {
+	sender      utils.LegionAddress
+	fingerprint string
+}
+
+// PeerFingerprint is the state fingerprint a peer reported
+type PeerFingerprint struct {
+	Address     string `json:"address"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Responded   bool   `json:"responded"`
+	Diverged    bool   `json:"diverged"`
+}
+
+// ConsistencyReport compares our state fingerprint with every known peer's
+type ConsistencyReport struct {
+	Fingerprint string            `json:"fingerprint"`
+	Peers       []PeerFingerprint `json:"peers"`
+	Diverged    int               `json:"diverged"`
+	NoResponse  int               `json:"no_response"`
+}
+
+// CheckConsistency asks every known peer for its state fingerprint and
+// reports the ones that differ from ours. Updates take time to spread, so a
+// peer that diverges once isn't necessarily out of sync.
+func (p *Peer) CheckConsistency(timeout time.Duration) *ConsistencyReport {
+	addrs := make([]utils.LegionAddress, 0)
+	p.net.DoAllPeers(func(peer *network.Peer) { addrs = append(addrs, peer.Remote()) })
+
+	replies := p.statePlugin.queryFingerprints(addrs, timeout)
+
+	ours := p.GetState().Fingerprint()
+	report := &ConsistencyReport{Fingerprint: ours, Peers: make([]PeerFingerprint, 0, len(addrs))}
+	for _, addr := range addrs {
+		pf := PeerFingerprint{Address: addr.String()}
+		if fp, ok := replies[addr]; ok {
+			pf.Responded = true
+			pf.Fingerprint = fp
+			pf.Diverged = fp != ours
+		}
+		if !pf.Responded {
+			report.NoResponse++
+		} else if pf.Diverged {
+			report.Diverged++
+		}
+		report.Peers = append(report.Peers, pf)
+	}
+
+	sort.Slice(report.Peers, func(i, j int) bool { return report.Peers[i].Address < report.Peers[j].Address })
+	return report
+}
+
+// queryFingerprints sends a fingerprint request to the peers and collects
+// the replies until they have all answered or the timeout passes
+func (state *StatePlugin) queryFingerprints(addrs []utils.LegionAddress, timeout time.Duration) map[utils.LegionAddress]string {
+	replies := make(map[utils.LegionAddress]string)
+	if len(addrs) == 0 {
+		return replies
+	}
+
+	c := make(chan fingerprintReply, len(addrs))
+	state.mux.Lock()
+	if state.fingerprintWaiters == nil {
+		state.fingerprintWaiters = make(map[chan fingerprintReply]bool)
+	}
+	state.fingerprintWaiters[c] = true
+	state.mux.Unlock()
+
+	defer func() {
+		state.mux.Lock()
+		delete(state.fingerprintWaiters, c)
+		state.mux.Unlock()
+	}()
+
+	state.l.Broadcast(state.l.NewMessage("fingerprint_request", []byte{}), addrs...)
+
+	deadline := time.After(timeout)
+	for len(replies) < len(addrs) {
+		select {
+		case reply := <-c:
+			replies[reply.sender] = reply.fingerprint
+		case <-deadline:
+			return replies
+		}
+	}
+	return replies
+}
+
+// handleFingerprintReply passes a fingerprint to everyone waiting for one
+func (state *StatePlugin) handleFingerprintReply(ctx *network.MessageContext) {
+	fp, err := jsonparser.GetString(ctx.Message.Body(), "fingerprint")
+	if err != nil {
+		return
+	}
+
+	state.mux.Lock()
+	defer state.mux.Unlock()
+	for c := range state.fingerprintWaiters {
+		select {
+		case c <- fingerprintReply{sender: ctx.Sender, fingerprint: fp}:
+		default:
+		}
+	}
+}
+
+func fingerprintMessageBody(fp string) []byte {
+	b, _ := json.Marshal(map[string]string{"fingerprint": fp})
+	return b
+}
@@ -0,0 +1,86 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/state"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// registerConfigFields registers the extra node and pool fields declared in
+// the [p2p.state] section of the config. Built in fields can't be replaced.
+func registerConfigFields(s *state.State) {
+	builtIn := s.GetSchema()
+
+	for field, raw := range viper.GetStringMap("P2P.State.Node") {
+		if _, exists := builtIn.Node[field]; exists {
+			log.Warn().Str("field", field).Msg("Config can't change a built in node field, ignoring it")
+			continue
+		}
+		schema, err := fieldSchemaFromConfig(raw)
+		if err != nil {
+			log.Error().Err(err).Str("field", field).Msg("Invalid node field in config")
+			continue
+		}
+		s.RegisterNodeField(field, schema)
+	}
+
+	for field, raw := range viper.GetStringMap("P2P.State.Pool") {
+		if _, exists := builtIn.Pool[field]; exists {
+			log.Warn().Str("field", field).Msg("Config can't change a built in pool field, ignoring it")
+			continue
+		}
+		schema, err := fieldSchemaFromConfig(raw)
+		if err != nil {
+			log.Error().Err(err).Str("field", field).Msg("Invalid pool field in config")
+			continue
+		}
+		s.RegisterPoolField(field, schema)
+	}
+}
+
+// fieldSchemaFromConfig builds a schema from a config value, which is either
+// a kind ("single" or "list"), a type name, or a table with the schema fields
+// like { type = "enum", values = ["a", "b"] }
+func fieldSchemaFromConfig(raw interface{}) (state.FieldSchema, error) {
+	schema := state.FieldSchema{}
+
+	switch v := raw.(type) {
+	case string:
+		schema.Type = state.FieldType(strings.ToLower(v))
+	case map[string]interface{}:
+		// The table keys match the json names of the schema
+		b, err := json.Marshal(v)
+		if err != nil {
+			return schema, err
+		}
+		err = json.Unmarshal(b, &schema)
+		if err != nil {
+			return schema, err
+		}
+		if kind, ok := v["kind"].(string); ok && schema.Type == "" {
+			schema.Type = state.FieldType(strings.ToLower(kind))
+		}
+	default:
+		return schema, fmt.Errorf("expected a string or table, got %T", raw)
+	}
+
+	switch schema.Type {
+	case "single":
+		schema.Type = state.TypeString
+	case "list":
+		schema.Type = state.TypeStringList
+	}
+
+	if !schema.Type.IsValid() {
+		return schema, fmt.Errorf("unknown field type %q", schema.Type)
+	}
+	if schema.Type == state.TypeEnum && len(schema.Values) == 0 {
+		return schema, fmt.Errorf("enum field needs a list of values")
+	}
+
+	return schema, nil
+}
@@ -0,0 +1,114 @@
+package peer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/state"
+	"github.com/spf13/viper"
+)
+
+func TestFieldSchemaFromConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     interface{}
+		schema  state.FieldSchema
+		wantErr bool
+	}{
+		{"single kind", "single", state.FieldSchema{Type: state.TypeString}, false},
+		{"list kind", "list", state.FieldSchema{Type: state.TypeStringList}, false},
+		{"type name", "Port", state.FieldSchema{Type: state.TypePort}, false},
+		{
+			"kind in a table",
+			map[string]interface{}{"kind": "list", "max_size": int64(64)},
+			state.FieldSchema{Type: state.TypeStringList, MaxSize: 64},
+			false,
+		},
+		{
+			"type in a table",
+			map[string]interface{}{"type": "int", "min": int64(1), "max": int64(10), "max_size": int64(8)},
+			state.FieldSchema{Type: state.TypeInt, Min: 1, Max: 10, MaxSize: 8},
+			false,
+		},
+		{
+			"enum",
+			map[string]interface{}{"type": "enum", "values": []interface{}{"us", "eu"}},
+			state.FieldSchema{Type: state.TypeEnum, Values: []string{"us", "eu"}},
+			false,
+		},
+		{"enum without values", map[string]interface{}{"type": "enum"}, state.FieldSchema{}, true},
+		{"unknown type name", "float", state.FieldSchema{}, true},
+		{"unknown type in a table", map[string]interface{}{"type": "blob"}, state.FieldSchema{}, true},
+		{"table without a type", map[string]interface{}{"max_size": int64(8)}, state.FieldSchema{}, true},
+		{"wrong table value", map[string]interface{}{"type": "int", "max": "ten"}, state.FieldSchema{}, true},
+		{"not a string or table", int64(5), state.FieldSchema{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := fieldSchemaFromConfig(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", schema)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(schema, tt.schema) {
+				t.Errorf("expected %+v, got %+v", tt.schema, schema)
+			}
+		})
+	}
+}
+
+func TestRegisterConfigFields(t *testing.T) {
+	viper.Set("P2P.State.Node", map[string]interface{}{
+		"region":    map[string]interface{}{"type": "enum", "values": []interface{}{"us", "eu"}},
+		"endpoints": "array",
+		"broken":    "float",
+		"http_port": "string", // Built in, can't be replaced
+	})
+	viper.Set("P2P.State.Pool", map[string]interface{}{
+		"announcements":    "list",
+		"required_content": "single", // Built in, can't be replaced
+	})
+	defer viper.Set("P2P.State.Node", map[string]interface{}{})
+	defer viper.Set("P2P.State.Pool", map[string]interface{}{})
+
+	s := state.New()
+	s.RegisterNodeField("http_port", state.FieldSchema{Type: state.TypePort})
+	s.RegisterPoolField("required_content", state.FieldSchema{Type: state.TypeStringList})
+	registerConfigFields(s)
+	schema := s.GetSchema()
+
+	tests := []struct {
+		name   string
+		fields map[string]state.FieldSchema
+		field  string
+		want   *state.FieldSchema
+	}{
+		{"table node field", schema.Node, "region", &state.FieldSchema{Type: state.TypeEnum, Values: []string{"us", "eu"}}},
+		{"type name node field", schema.Node, "endpoints", &state.FieldSchema{Type: state.TypeArray}},
+		{"invalid node field", schema.Node, "broken", nil},
+		{"built in node field", schema.Node, "http_port", &state.FieldSchema{Type: state.TypePort}},
+		{"kind pool field", schema.Pool, "announcements", &state.FieldSchema{Type: state.TypeStringList}},
+		{"built in pool field", schema.Pool, "required_content", &state.FieldSchema{Type: state.TypeStringList}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.fields[tt.field]
+			if tt.want == nil {
+				if ok {
+					t.Errorf("invalid field was registered as %+v", got)
+				}
+				return
+			}
+			if !ok || !reflect.DeepEqual(got, *tt.want) {
+				t.Errorf("expected %+v, got %+v", *tt.want, got)
+			}
+		})
+	}
+}
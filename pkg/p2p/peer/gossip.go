@@ -0,0 +1,215 @@
+package peer
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"sync"
+
+	"github.com/buger/jsonparser"
+	"github.com/gladiusio/legion/network"
+	"github.com/gladiusio/legion/utils"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/state"
+)
+
+// seenCache remembers the hashes of the most recent state messages so copies
+// relayed to us by several peers are only handled once
+type seenCache struct {
+	seen  map[string]bool
+	order []string
+	next  int
+	mux   sync.Mutex
+}
+
+func newSeenCache(size int) *seenCache {
+	if size < 1 {
+		size = 1
+	}
+	return &seenCache{seen: make(map[string]bool, size), order: make([]string, size)}
+}
+
+// Has returns true if the hash has been seen
+func (c *seenCache) Has(hash []byte) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.seen[string(hash)]
+}
+
+// Add records the hash, forgetting the oldest one if the cache is full
+func (c *seenCache) Add(hash []byte) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	key := string(hash)
+	if c.seen[key] {
+		return
+	}
+	delete(c.seen, c.order[c.next])
+	c.order[c.next] = key
+	c.seen[key] = true
+	c.next = (c.next + 1) % len(c.order)
+}
+
+// gossipConfig is how far state updates are relayed
+type gossipConfig struct {
+	// Fanout is how many random peers each update is sent to, 0 or less sends
+	// it to every peer
+	Fanout int
+
+	// MaxHops is how many times an update is relayed before it's dropped
+	MaxHops int
+}
+
+func gossipConfigFromViper() gossipConfig {
+	return gossipConfig{
+		Fanout:  viper.GetInt("P2P.Gossip.Fanout"),
+		MaxHops: viper.GetInt("P2P.Gossip.MaxHops"),
+	}
+}
+
+// gossipTargets picks up to fanout random peers that aren't excluded
+func gossipTargets(peers []utils.LegionAddress, fanout int, exclude ...utils.LegionAddress) []utils.LegionAddress {
+	targets := make([]utils.LegionAddress, 0, len(peers))
+	for _, addr := range peers {
+		excluded := false
+		for _, e := range exclude {
+			if addr == e {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			targets = append(targets, addr)
+		}
+	}
+
+	if fanout > 0 && len(targets) > fanout {
+		rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+		targets = targets[:fanout]
+	}
+	return targets
+}
+
+// handleStateUpdate applies a gossiped state update and relays it on if it was
+// new to us. Copies we've already seen are dropped without verifying them
+// again.
+func (state *StatePlugin) handleStateUpdate(ctx *network.MessageContext) {
+	body := ctx.Message.Body()
+	sm, err := parseSignedMessage(body)
+	if err != nil {
+		log.Warn().Err(err).Str("sender", ctx.Sender.String()).Msg("Malformed state update")
+		state.scores.Penalize(ctx.Sender, offenseMalformed)
+		return
+	}
+	if state.seen.Has(sm.Hash) {
+		return
+	}
+	hops, ok := parseHops(body, state.gossip.MaxHops)
+	if !ok {
+		log.Warn().Str("sender", ctx.Sender.String()).Msg("State update with an invalid hop count")
+		state.scores.Penalize(ctx.Sender, offenseMalformed)
+		return
+	}
+
+	job := &verifyJob{sm: sm, relay: true, hops: hops, sender: ctx.Sender}
+	if !state.verifier.SubmitUpdate(job) {
+		log.Debug().Str("sender", ctx.Sender.String()).Msg("Verification queue full, dropped state update")
+	}
+}
+
+// parseHops returns how many times the update has been relayed. Peers that
+// don't relay don't send a hop count, so a missing one is 0. The count is set
+// by the sender, so anything negative is rejected and anything over maxHops is
+// treated as maxHops so it isn't relayed further.
+func parseHops(body []byte, maxHops int) (int, bool) {
+	hops, err := jsonparser.GetInt(body, "hops")
+	if err == jsonparser.KeyPathNotFoundError {
+		return 0, true
+	}
+	if err != nil || hops < 0 {
+		return 0, false
+	}
+	if hops > int64(maxHops) {
+		return maxHops, true
+	}
+	return int(hops), true
+}
+
+// handleVerifyJob is run by the verifier workers, it applies the message and
+// relays direct updates that were new to us
+func (state *StatePlugin) handleVerifyJob(job *verifyJob) bool {
+	// Another copy may have been handled while this one was queued
+	if state.seen.Has(job.sm.Hash) {
+		return false
+	}
+	err := state.applyUpdate(job.sm)
+	if !isVerified(err) && !job.sm.IsVerified() {
+		// Only a bad signature is the sender's fault, membership can fail
+		// because the pool server is down
+		state.scores.Penalize(job.sender, offenseUnverified)
+	}
+	if err != nil {
+		return false
+	}
+	if job.relay && job.hops < state.gossip.MaxHops {
+		state.relay(job.sm, job.hops+1, job.sender)
+	}
+	return true
+}
+
+// applyUpdate updates the state with the message, returning an error if it
+// didn't change anything. Only messages that were applied or are already
+// superseded are remembered. Other rejections can depend on when the message
+// arrives (like its node looking expired) or be a forged copy, and remembering
+// those would stop a later sync from delivering the message.
+func (state *StatePlugin) applyUpdate(sm *signature.SignedMessage) error {
+	err := state.peerState.UpdateState(sm)
+	if isSettled(err) {
+		state.seen.Add(sm.Hash)
+	}
+	return err
+}
+
+// isVerified returns true unless the update failed because the message wasn't
+// verified
+func isVerified(err error) bool {
+	return err != state.ErrNotVerified
+}
+
+// isSettled returns true if the update was applied or was already superseded,
+// either way handling it again wouldn't change anything
+func isSettled(err error) bool {
+	return err == nil || err == state.ErrStale
+}
+
+// relay sends the message to a random set of peers other than the ones it
+// came from
+func (state *StatePlugin) relay(sm *signature.SignedMessage, hops int, exclude ...utils.LegionAddress) {
+	peers := make([]utils.LegionAddress, 0)
+	state.l.DoPromotedPeers(func(p *network.Peer) { peers = append(peers, p.Remote()) })
+	targets := gossipTargets(peers, state.gossip.Fanout, exclude...)
+	if len(targets) == 0 {
+		return
+	}
+
+	b, err := gossipMessageBody(sm, hops)
+	if err != nil {
+		log.Error().Err(err).Msg("Error encoding state update")
+		return
+	}
+	state.l.Broadcast(state.l.NewMessage("state_update", b), targets...)
+}
+
+// gossipMessageBody is the signed message with the number of times it has
+// been relayed
+func gossipMessageBody(sm *signature.SignedMessage, hops int) ([]byte, error) {
+	b, err := json.Marshal(sm)
+	if err != nil {
+		return nil, err
+	}
+	return jsonparser.Set(b, []byte(strconv.Itoa(hops)), "hops")
+}
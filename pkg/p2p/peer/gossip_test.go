@@ -0,0 +1,118 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gladiusio/legion/utils"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/state"
+)
+
+func TestSeenCacheForgetsOldest(t *testing.T) {
+	c := newSeenCache(2)
+	c.Add([]byte("a"))
+	c.Add([]byte("b"))
+	c.Add([]byte("a"))
+	if !c.Has([]byte("a")) || !c.Has([]byte("b")) {
+		t.Fatal("cache forgot a hash before it was full")
+	}
+
+	c.Add([]byte("c"))
+	if c.Has([]byte("a")) || !c.Has([]byte("b")) || !c.Has([]byte("c")) {
+		t.Error("cache didn't forget the oldest hash")
+	}
+}
+
+func TestGossipTargets(t *testing.T) {
+	peers := []utils.LegionAddress{
+		utils.NewLegionAddress("10.0.0.1", 7947),
+		utils.NewLegionAddress("10.0.0.2", 7947),
+		utils.NewLegionAddress("10.0.0.3", 7947),
+	}
+
+	targets := gossipTargets(peers, 2, peers[0])
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %d", len(targets))
+	}
+	for _, addr := range targets {
+		if addr == peers[0] {
+			t.Error("update was sent back to the peer it came from")
+		}
+	}
+
+	if targets := gossipTargets(peers, 0); len(targets) != 3 {
+		t.Errorf("expected every peer without a fanout, got %d", len(targets))
+	}
+}
+
+func TestGossipMessageBodyKeepsSignedMessage(t *testing.T) {
+	h := json.RawMessage(`{"content":{"node":{"heartbeat":1}},"timestamp":100}`)
+	sm := &signature.SignedMessage{Message: &h, Hash: []byte("hash"), Signature: []byte("signature"), Address: "0x1"}
+
+	b, err := gossipMessageBody(sm, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hops, _ := jsonparser.GetInt(b, "hops"); hops != 3 {
+		t.Errorf("expected 3 hops, got %d", hops)
+	}
+
+	parsed, err := parseSignedMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.Hash, sm.Hash) || parsed.Address != sm.Address {
+		t.Error("relayed message doesn't match the original")
+	}
+}
+
+func TestParseHops(t *testing.T) {
+	tests := []struct {
+		body string
+		hops int
+		ok   bool
+	}{
+		{`{}`, 0, true},
+		{`{"hops":2}`, 2, true},
+		{`{"hops":100}`, 6, true},
+		{`{"hops":-1}`, 0, false},
+		{`{"hops":"two"}`, 0, false},
+	}
+	for _, test := range tests {
+		hops, ok := parseHops([]byte(test.body), 6)
+		if hops != test.hops || ok != test.ok {
+			t.Errorf("%s: expected %d, %t got %d, %t", test.body, test.hops, test.ok, hops, ok)
+		}
+	}
+}
+
+func TestApplyUpdateOnlyRemembersSettledMessages(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	s := state.New()
+	s.SetMembershipProvider(signature.NewMemoryProvider(crypto.PubkeyToAddress(key.PublicKey).String()))
+	s.RegisterNodeField("heartbeat", state.FieldSchema{Type: state.TypeInt})
+	s.SetClockBounds(time.Minute, 0)
+	sp := &StatePlugin{peerState: s, seen: newSeenCache(10)}
+
+	applied := signTestMessage(t, key, `{"node":{"heartbeat":2}}`)
+	stale := signTestMessageAt(t, key, `{"node":{"heartbeat":1}}`, time.Now().Unix()-10)
+	future := signTestMessageAt(t, key, `{"node":{"heartbeat":3}}`, time.Now().Unix()+3600)
+	stranger, _ := crypto.GenerateKey()
+	unverified := signTestMessage(t, stranger, `{"node":{"heartbeat":1}}`)
+
+	for _, sm := range []*signature.SignedMessage{applied, stale, future, unverified} {
+		sp.applyUpdate(sm)
+	}
+	if !sp.seen.Has(applied.Hash) || !sp.seen.Has(stale.Hash) {
+		t.Error("applied or stale message wasn't remembered")
+	}
+	if sp.seen.Has(future.Hash) || sp.seen.Has(unverified.Hash) {
+		t.Error("message that could still be accepted later was remembered")
+	}
+}
@@ -0,0 +1,82 @@
+package peer
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/message"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// How long we wait before checking the wallet again when it is locked, this
+// doubles up to the heartbeat interval
+const heartbeatLockedBackoff = 5 * time.Second
+
+// publishHeartbeats signs and pushes a heartbeat every interval until the peer
+// is stopped. While the wallet is locked it waits with an increasing backoff.
+func (p *Peer) publishHeartbeats(interval time.Duration) {
+	heartbeatLoop(interval, p.isRunning, p.ga.Unlocked, p.sendHeartbeat, time.Sleep)
+}
+
+// heartbeatLoop calls send every interval for as long as running returns true,
+// waiting with a backoff that doubles up to the interval while unlocked
+// returns false
+func heartbeatLoop(interval time.Duration, running, unlocked func() bool, send func() error, sleep func(time.Duration)) {
+	if interval <= 0 {
+		interval = 1 * time.Minute
+	}
+	backoff := heartbeatLockedBackoff
+	for running() {
+		if !unlocked() {
+			log.Debug().Dur("retry_in", backoff).Msg("Wallet is locked, waiting to send heartbeat")
+			sleep(backoff)
+			backoff *= 2
+			if backoff > interval {
+				backoff = interval
+			}
+			continue
+		}
+		backoff = heartbeatLockedBackoff
+
+		err := send()
+		if err != nil {
+			log.Warn().Err(err).Msg("Error sending heartbeat")
+		}
+		sleep(interval)
+	}
+}
+
+// sendHeartbeat signs a heartbeat update, along with any configured address
+// fields, and pushes it to the network
+func (p *Peer) sendHeartbeat() error {
+	b, err := json.Marshal(map[string]interface{}{"node": heartbeatFields()})
+	if err != nil {
+		return err
+	}
+
+	sm, err := p.SignMessage(message.New(b))
+	if err != nil {
+		return err
+	}
+
+	_, err = p.UpdateAndPushState(sm)
+	return err
+}
+
+// heartbeatFields returns the node fields sent with every heartbeat
+func heartbeatFields() map[string]interface{} {
+	fields := map[string]interface{}{"heartbeat": time.Now().Unix()}
+
+	if ip := viper.GetString("P2P.Heartbeat.IPAddress"); ip != "" {
+		fields["ip_address"] = ip
+	}
+	if port := viper.GetInt("P2P.Heartbeat.HTTPPort"); port != 0 {
+		fields["http_port"] = port
+	}
+	if port := viper.GetInt("P2P.Heartbeat.ContentPort"); port != 0 {
+		fields["content_port"] = port
+	}
+
+	return fields
+}
@@ -0,0 +1,63 @@
+package peer
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestHeartbeatFields(t *testing.T) {
+	fields := heartbeatFields()
+	if len(fields) != 1 {
+		t.Errorf("expected only the heartbeat without any addresses configured, got %v", fields)
+	}
+	if heartbeat, ok := fields["heartbeat"].(int64); !ok || time.Now().Unix()-heartbeat > 1 {
+		t.Errorf("heartbeat isn't the current time: %v", fields["heartbeat"])
+	}
+
+	viper.Set("P2P.Heartbeat.IPAddress", "10.0.0.1")
+	viper.Set("P2P.Heartbeat.HTTPPort", 8080)
+	viper.Set("P2P.Heartbeat.ContentPort", 8081)
+	defer viper.Set("P2P.Heartbeat.IPAddress", "")
+	defer viper.Set("P2P.Heartbeat.HTTPPort", 0)
+	defer viper.Set("P2P.Heartbeat.ContentPort", 0)
+
+	fields = heartbeatFields()
+	delete(fields, "heartbeat")
+	expected := map[string]interface{}{"ip_address": "10.0.0.1", "http_port": 8080, "content_port": 8081}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expected %v, got %v", expected, fields)
+	}
+}
+
+func TestHeartbeatLoopBacksOffWhileLocked(t *testing.T) {
+	interval := 30 * time.Second
+	// Locked for 5 checks, then unlocked for one heartbeat, then locked again
+	locked := []bool{true, true, true, true, true, false, true}
+	checks, sent := 0, 0
+	var slept []time.Duration
+
+	heartbeatLoop(interval,
+		func() bool { return checks < len(locked) },
+		func() bool {
+			checks++
+			return !locked[checks-1]
+		},
+		func() error {
+			sent++
+			return errors.New("keeps going after errors")
+		},
+		func(d time.Duration) { slept = append(slept, d) },
+	)
+
+	expected := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, interval, interval, interval, 5 * time.Second}
+	if !reflect.DeepEqual(slept, expected) {
+		t.Errorf("expected waits %v, got %v", expected, slept)
+	}
+	if sent != 1 {
+		t.Errorf("expected 1 heartbeat, sent %d", sent)
+	}
+}
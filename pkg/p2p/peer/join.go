@@ -0,0 +1,211 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/legion/utils"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// SeedResult is what happened when we tried to join through a seed. Pending
+// seeds are still connecting in the background.
+type SeedResult struct {
+	Address  string `json:"address"`
+	Joined   bool   `json:"joined"`
+	Pending  bool   `json:"pending,omitempty"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// JoinResult is the outcome of every seed in a join request
+type JoinResult struct {
+	Joined bool         `json:"joined"`
+	Seeds  []SeedResult `json:"seeds"`
+}
+
+// joinConfig is how hard we try to reach each seed
+type joinConfig struct {
+	// Attempts is how many times each seed is tried
+	Attempts int
+
+	// Timeout is how long each attempt can take
+	Timeout time.Duration
+
+	// Backoff is the wait before the first retry, it doubles after every
+	// failed attempt
+	Backoff time.Duration
+}
+
+func joinConfigFromViper() joinConfig {
+	return joinConfig{
+		Attempts: viper.GetInt("P2P.Join.Attempts"),
+		Timeout:  viper.GetDuration("P2P.Join.Timeout"),
+		Backoff:  viper.GetDuration("P2P.Join.Backoff"),
+	}
+}
+
+// Join requests to join the network through a list of seed peers. Every seed
+// is tried at the same time, and retried with a growing delay if it can't be
+// reached. Join returns as soon as one of them is joined, the rest carry on in
+// the background. An error is returned if none of them could be joined.
+func (p *Peer) Join(addressList []string) (*JoinResult, error) {
+	if viper.GetString("P2P.BindAddress") == "" {
+		return nil, errors.New("can't join network, bind address is not correctly detected or set")
+	}
+	if viper.GetString("P2P.AdvertiseAddress") == "" {
+		return nil, errors.New("can't join network, advertise address is not correctly detected or set")
+	}
+	if len(addressList) == 0 {
+		return nil, errors.New("no seed addresses provided")
+	}
+
+	var bootstrap sync.Once
+	result := joinSeeds(addressList, joinConfigFromViper(), p.net.PromotePeer, func(addr utils.LegionAddress) {
+		bootstrap.Do(p.discovery.Bootstrap)
+		go func() {
+			time.Sleep(1 * time.Second)
+			p.statePlugin.requestSync(addr)
+		}()
+	})
+	if !result.Joined {
+		for _, seed := range result.Seeds {
+			if seed.Pending {
+				return result, errors.New("couldn't join any of the seeds yet, some are still connecting")
+			}
+		}
+		return result, errors.New("couldn't join any of the seeds")
+	}
+	return result, nil
+}
+
+// joinSeeds connects to every seed with retries, calling joined for each one
+// that succeeds as soon as it does. It returns once the first seed is joined
+// or every seed has run out of attempts.
+func joinSeeds(addressList []string, config joinConfig, connect func(...utils.LegionAddress) error, joined func(utils.LegionAddress)) *JoinResult {
+	seeds := make([]SeedResult, len(addressList))
+	var mux sync.Mutex
+
+	// Buffered so seeds still going after we return never block
+	finished := make(chan bool, len(addressList))
+	running := 0
+	for i, addrString := range addressList {
+		seeds[i].Address = addrString
+		addr, ok := parseLegionAddress(addrString)
+		if !ok {
+			seeds[i].Error = fmt.Sprintf("invalid address string provided: %s", addrString)
+			continue
+		}
+
+		running++
+		seeds[i].Pending = true
+		go func(seed *SeedResult, addr utils.LegionAddress) {
+			done := func(err error) {
+				mux.Lock()
+				seed.Pending = false
+				seed.Joined = err == nil
+				seed.Error = ""
+				if err != nil {
+					seed.Error = err.Error()
+				}
+				mux.Unlock()
+
+				if err != nil {
+					log.Warn().Err(err).Str("seed", addr.String()).Msg("Couldn't join seed")
+					return
+				}
+				joined(addr)
+			}
+
+			dial, err := joinSeed(addr, config, connect, func() {
+				mux.Lock()
+				seed.Attempts++
+				mux.Unlock()
+			})
+			if dial == nil {
+				done(err)
+				finished <- err == nil
+				return
+			}
+
+			// Out of attempts but the last dial hasn't returned, it's reported
+			// as pending until it does
+			mux.Lock()
+			seed.Error = err.Error()
+			mux.Unlock()
+			finished <- false
+			done(<-dial)
+		}(&seeds[i], addr)
+	}
+
+	for ; running > 0; running-- {
+		if <-finished {
+			break
+		}
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	result := &JoinResult{Seeds: append([]SeedResult{}, seeds...)}
+	for _, seed := range result.Seeds {
+		result.Joined = result.Joined || seed.Joined
+	}
+	return result
+}
+
+// joinSeed tries to connect to the seed until it works or we run out of
+// attempts, calling attempt before each one. Legion dials without a timeout,
+// so an attempt that times out leaves its dial running and the next attempt
+// waits on that dial instead of starting another. If the last dial still
+// hasn't returned it is returned along with the timeout error.
+func joinSeed(addr utils.LegionAddress, config joinConfig, connect func(...utils.LegionAddress) error, attempt func()) (<-chan error, error) {
+	attempts := config.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := config.Backoff
+
+	var err error
+	var dial chan error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		attempt()
+
+		if dial == nil {
+			dial = make(chan error, 1)
+			go func(dial chan error) { dial <- connect(addr) }(dial)
+		}
+		var returned bool
+		err, returned = waitForDial(dial, config.Timeout)
+		if returned {
+			dial = nil
+			if err == nil {
+				return nil, nil
+			}
+		}
+	}
+	if dial == nil {
+		return nil, err
+	}
+	return dial, err
+}
+
+// waitForDial waits up to the timeout for the dial to return, returned is
+// false if it didn't
+func waitForDial(dial <-chan error, timeout time.Duration) (err error, returned bool) {
+	if timeout <= 0 {
+		return <-dial, true
+	}
+	select {
+	case err := <-dial:
+		return err, true
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out connecting after %s", timeout), false
+	}
+}
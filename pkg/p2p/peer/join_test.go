@@ -0,0 +1,98 @@
+package peer
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/legion/utils"
+)
+
+func TestJoinSeedsRetriesWithoutDialingTwice(t *testing.T) {
+	var mux sync.Mutex
+	tries := make(map[string]int)
+	release := make(chan struct{})
+	connect := func(addrs ...utils.LegionAddress) error {
+		addr := addrs[0].String()
+		mux.Lock()
+		tries[addr]++
+		mux.Unlock()
+		if addr == "10.0.0.3:7947" {
+			// Doesn't answer until it's released
+			<-release
+			return nil
+		}
+		return errors.New("connection refused")
+	}
+
+	joined := make(chan utils.LegionAddress, 1)
+	config := joinConfig{Attempts: 3, Timeout: 20 * time.Millisecond, Backoff: time.Millisecond}
+	result := joinSeeds([]string{"10.0.0.2:7947", "10.0.0.3:7947", "no port"}, config, connect, func(addr utils.LegionAddress) {
+		joined <- addr
+	})
+
+	if result.Joined {
+		t.Fatal("joined without any seed answering")
+	}
+	expected := []SeedResult{
+		{Address: "10.0.0.2:7947", Attempts: 3},
+		{Address: "10.0.0.3:7947", Attempts: 3, Pending: true},
+		{Address: "no port"},
+	}
+	for i, seed := range result.Seeds {
+		if seed.Address != expected[i].Address || seed.Joined || seed.Pending != expected[i].Pending || seed.Attempts != expected[i].Attempts {
+			t.Errorf("unexpected outcome: %+v", seed)
+		}
+		if seed.Error == "" {
+			t.Errorf("no error for seed %s", seed.Address)
+		}
+	}
+	mux.Lock()
+	if tries["10.0.0.2:7947"] != 3 || tries["10.0.0.3:7947"] != 1 {
+		t.Errorf("unexpected dials: %v", tries)
+	}
+	mux.Unlock()
+
+	// The dial that outlived its attempts still joins
+	close(release)
+	select {
+	case addr := <-joined:
+		if addr.String() != "10.0.0.3:7947" {
+			t.Errorf("joined the wrong seed: %s", addr)
+		}
+	case <-time.After(time.Second):
+		t.Error("slow seed wasn't joined once it answered")
+	}
+}
+
+func TestJoinSeedsReturnsOnFirstSeed(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	connect := func(addrs ...utils.LegionAddress) error {
+		if addrs[0].String() == "10.0.0.2:7947" {
+			<-release
+		}
+		return nil
+	}
+
+	config := joinConfig{Attempts: 3, Timeout: time.Second, Backoff: time.Second}
+	start := time.Now()
+	result := joinSeeds([]string{"10.0.0.1:7947", "10.0.0.2:7947"}, config, connect, func(utils.LegionAddress) {})
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("waited for the slow seed")
+	}
+	if !result.Joined || !result.Seeds[0].Joined || !result.Seeds[1].Pending {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+func TestJoinSeedsFailsWithoutAnySeed(t *testing.T) {
+	connect := func(addrs ...utils.LegionAddress) error { return errors.New("connection refused") }
+	result := joinSeeds([]string{"10.0.0.1:7947"}, joinConfig{Attempts: 1}, connect, func(utils.LegionAddress) {
+		t.Error("joined callback called for a failed seed")
+	})
+	if result.Joined || result.Seeds[0].Attempts != 1 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
@@ -0,0 +1,35 @@
+package peer
+
+import (
+	"time"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/state"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// staleAfter is how long a node can go without a new signed message before it
+// is considered offline
+func staleAfter() time.Duration {
+	return viper.GetDuration("P2P.Liveness.StaleAfter")
+}
+
+// GetNodeStatuses returns how recently every node in the state was heard from
+func (p *Peer) GetNodeStatuses() []state.NodeStatus {
+	return p.GetState().GetNodeStatuses(staleAfter())
+}
+
+// expireNodes periodically removes nodes from the state that haven't sent a
+// message within the configured expiry, and deletes past their retention
+func (p *Peer) expireNodes() {
+	for {
+		time.Sleep(1 * time.Minute)
+		removed := p.GetState().ExpireNodes()
+		if len(removed) > 0 {
+			log.Info().Strs("nodes", removed).Msg("Removed expired nodes from state")
+		}
+		if n := p.GetState().ExpireTombstones(); n > 0 {
+			log.Debug().Int("tombstones", n).Msg("Removed expired tombstones from state")
+		}
+	}
+}
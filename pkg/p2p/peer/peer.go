@@ -1,15 +1,12 @@
 package peer
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"strings"
 	"sync"
-	"time"
 
-	mapset "github.com/deckarep/golang-set"
 	"github.com/gladiusio/gladius-common/pkg/blockchain"
 	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/message"
 	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
@@ -27,22 +24,71 @@ import (
 func New(ga *blockchain.GladiusAccountManager) *Peer {
 	// Setup our state and register accepted fields
 	s := state.New()
-	s.RegisterNodeSingleFields("ip_address", "content_port", "heartbeat", "http_port")
-	s.RegisterNodeListFields("disk_content")
+	s.RegisterNodeField("ip_address", state.FieldSchema{Type: state.TypeHost, MaxSize: 253})
+	s.RegisterNodeField("content_port", state.FieldSchema{Type: state.TypePort})
+	s.RegisterNodeField("http_port", state.FieldSchema{Type: state.TypePort})
+	s.RegisterNodeField("heartbeat", state.FieldSchema{Type: state.TypeInt})
+	s.RegisterNodeField("disk_content", state.FieldSchema{Type: state.TypeStringList, MaxSize: 1024})
+	// A number, or an object describing the node with its weight under "weight"
+	s.RegisterNodeField("capacity", state.FieldSchema{Type: state.TypeJSON, MaxSize: 1024})
 
-	s.RegisterPoolListFields("required_content")
+	s.RegisterPoolField("required_content", state.FieldSchema{Type: state.TypeStringList, MaxSize: 1024})
+
+	// Add any extra fields from the config
+	registerConfigFields(s)
+
+	// Choose who is allowed to update the state
+	mp, err := signature.NewMembershipProviderFromConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("Error creating membership provider, no state updates will be accepted")
+		mp = signature.NewMemoryProvider()
+	}
+	s.SetMembershipProvider(mp)
+
+	// Forget nodes that have been gone too long
+	s.SetNodeExpiry(viper.GetDuration("P2P.Liveness.ExpireAfter"))
+	s.SetTombstoneRetention(viper.GetDuration("P2P.Tombstones.Retention"))
+
+	// Don't trust signers' clocks too far
+	s.SetClockBounds(viper.GetDuration("P2P.Clock.MaxSkew"), viper.GetDuration("P2P.Clock.MaxMessageAge"))
+
+	// Restore the state from the last run if journaling is enabled
+	if journalPath := viper.GetString("P2P.StateJournal"); journalPath != "" {
+		j, err := state.OpenJournal(journalPath)
+		if err != nil {
+			log.Error().Err(err).Str("path", journalPath).Msg("Error opening state journal, state will not be persisted")
+		} else {
+			restored, err := s.LoadJournal(j)
+			if err != nil {
+				log.Error().Err(err).Str("path", journalPath).Msg("Error restoring state from journal")
+			}
+			log.Info().Int("messages", restored).Msg("Restored state from journal")
+		}
+	}
 
 	conf := legion.DefaultConfig(viper.GetString("P2P.BindAddress"), uint16(viper.GetInt("P2P.BindPort")))
 	// Set up the advertise address
 	conf.AdvertiseAddress = utils.NewLegionAddress(viper.GetString("P2P.AdvertiseAddress"), uint16(viper.GetInt("P2P.AdvertisePort")))
+	// Drop messages from banned peers before any plugin sees them
+	scores := newScoreboard(scoringConfigFromViper(), nil)
+	conf.MessageValidator = scores.ValidateMessage
 	l := legion.New(conf)
+	scores.onBan = disconnectBanned(l)
+	scores.isConnected = l.PeerExists
 
 	disc := new(simpledisc.Plugin)
 
 	l.RegisterPlugin(disc)
+	topology := newTopologyPlugin()
+	l.RegisterPlugin(topology)
 	// Create our state plugin
 	statePlugin := new(StatePlugin)
 	statePlugin.peerState = s
+	statePlugin.l = l
+	statePlugin.seen = newSeenCache(viper.GetInt("P2P.Gossip.SeenCacheSize"))
+	statePlugin.gossip = gossipConfigFromViper()
+	statePlugin.verifier = newVerifierFromViper(statePlugin.handleVerifyJob)
+	statePlugin.scores = scores
 	l.RegisterPlugin(statePlugin)
 
 	go func() {
@@ -53,52 +99,36 @@ func New(ga *blockchain.GladiusAccountManager) *Peer {
 	}()
 
 	peer := &Peer{
-		ga:        ga,
-		discovery: disc,
-		peerState: s,
-		net:       l,
-		running:   true,
-		mux:       sync.Mutex{},
+		ga:          ga,
+		discovery:   disc,
+		topology:    topology,
+		statePlugin: statePlugin,
+		strategies:  newSelectionStrategies(),
+		peerState:   s,
+		net:         l,
+		running:     true,
+		mux:         sync.Mutex{},
+	}
+	go peer.expireNodes()
+
+	if viper.GetBool("P2P.Heartbeat.Enabled") {
+		go peer.publishHeartbeats(viper.GetDuration("P2P.Heartbeat.Interval"))
 	}
+
 	return peer
 }
 
 // Peer is a type that represents a peer in the Gladius p2p network.
 type Peer struct {
-	ga        *blockchain.GladiusAccountManager
-	peerState *state.State
-	net       *network.Legion
-	running   bool
-	discovery *simpledisc.Plugin
-	mux       sync.Mutex
-}
-
-// Join will request to join the network from a specific node
-func (p *Peer) Join(addressList []string) error {
-	if viper.GetString("P2P.BindAddress") == "" {
-		return errors.New("can't join network, bind address is not correctly detected or set")
-	}
-	if viper.GetString("P2P.AdvertiseAddress") == "" {
-		return errors.New("can't join network, advertise address is not correctly detected or set")
-	}
-	addrs := make([]utils.LegionAddress, 0)
-	for _, addrString := range addressList {
-		addr := utils.LegionAddressFromString(addrString)
-		if !addr.IsValid() {
-			return fmt.Errorf("invalid address string provided: %s", addrString)
-		}
-		addrs = append(addrs, addr)
-	}
-	err := p.net.PromotePeer(addrs[0])
-	if err != nil {
-		return err
-	}
-	p.discovery.Bootstrap()
-	go func() {
-		time.Sleep(1 * time.Second)
-		p.net.Broadcast(p.net.NewMessage("sync_request", []byte{}), addrs...)
-	}()
-	return nil
+	ga          *blockchain.GladiusAccountManager
+	peerState   *state.State
+	net         *network.Legion
+	running     bool
+	discovery   *simpledisc.Plugin
+	topology    *TopologyPlugin
+	statePlugin *StatePlugin
+	strategies  map[string]SelectionStrategy
+	mux         sync.Mutex
 }
 
 // UnlockWallet unlocks the local peer's wallet
@@ -107,6 +137,18 @@ func (p *Peer) UnlockWallet(password string) error {
 	return err
 }
 
+// SetMembershipProvider changes the provider used to decide who is part of the
+// pool
+func (p *Peer) SetMembershipProvider(mp signature.MembershipProvider) {
+	p.GetState().SetMembershipProvider(mp)
+}
+
+// VerifyMessage returns true if the message has a valid signature from a
+// member of the pool
+func (p *Peer) VerifyMessage(sm *signature.SignedMessage) bool {
+	return sm.IsMemberAndVerified(p.GetState().MembershipProvider())
+}
+
 // SignMessage signs the message with the peer's internal account manager
 func (p *Peer) SignMessage(m *message.Message) (*signature.SignedMessage, error) {
 	return signature.CreateSignedMessage(m, p.ga)
@@ -114,33 +156,38 @@ func (p *Peer) SignMessage(m *message.Message) (*signature.SignedMessage, error)
 
 // Stop will stop the peer
 func (p *Peer) Stop() {
+	p.mux.Lock()
+	p.running = false
+	p.mux.Unlock()
+
 	p.net.Stop()
 }
 
-// SetState sets the internal state of the peer without validation
-func (p *Peer) SetState(s *state.State) {
+func (p *Peer) isRunning() bool {
 	p.mux.Lock()
-	p.peerState = s
-	p.mux.Unlock()
+	defer p.mux.Unlock()
+	return p.running
 }
 
-// UpdateAndPushState updates the local state and pushes it to several other peers
-func (p *Peer) UpdateAndPushState(sm *signature.SignedMessage) error {
-	err := p.GetState().UpdateState(sm)
-	if err != nil {
-		return err
-	}
+// RebuildState verifies and applies the signed messages to the local state,
+// like the output of another peer's signature list
+func (p *Peer) RebuildState(sms []*signature.SignedMessage) *state.RebuildResult {
+	return p.GetState().Rebuild(sms)
+}
 
-	signedBytes, err := json.Marshal(sm)
+// UpdateAndPushState updates the local state and pushes it to several other
+// peers, returning what happened to each field in the message. The peers relay
+// it on to the rest of the network.
+func (p *Peer) UpdateAndPushState(sm *signature.SignedMessage) (*state.UpdateResult, error) {
+	result, err := p.GetState().ApplyUpdate(sm)
 	if err != nil {
-		return err
+		return result, err
 	}
 
-	toSend := p.net.NewMessage("state_update", signedBytes)
-
-	p.net.Broadcast(toSend)
+	p.statePlugin.seen.Add(sm.Hash)
+	p.statePlugin.relay(sm, 0)
 
-	return nil
+	return result, nil
 }
 
 // GetState returns the current local state
@@ -152,67 +199,94 @@ func (p *Peer) GetState() *state.State {
 // and returns a list of the missing files names in the format of:
 // website/<"asset" or "route">/filename
 func (p *Peer) CompareContent(contentList []string) []interface{} {
-	// Convert to an interface array
-	cl := make([]interface{}, len(contentList))
-	for i, v := range contentList {
-		cl[i] = v
+	contentWeNeed := make([]interface{}, 0)
+	contentField, ok := p.GetState().GetPoolField("required_content").(*state.SignedList)
+	if !ok {
+		return contentWeNeed
 	}
-	contentWeHaveSet := mapset.NewSetFromSlice(cl)
 
-	contentField := p.GetState().GetPoolField("required_content")
-	if contentField == nil {
-		return make([]interface{}, 0)
+	contentWeHave := make(map[string]bool, len(contentList))
+	for _, content := range contentList {
+		contentWeHave[content] = true
 	}
-	contentFromPool := contentField.(*state.SignedList).Data
-
-	// Convert to an interface array
-	s := make([]interface{}, len(contentFromPool))
-	for i, v := range contentFromPool {
-		s[i] = v
+	for _, content := range contentField.Data {
+		if !contentWeHave[content] {
+			contentWeNeed = append(contentWeNeed, content)
+			contentWeHave[content] = true
+		}
 	}
+	return contentWeNeed
+}
 
-	// Create a set
-	contentWeNeed := mapset.NewSetFromSlice(s)
+// ContentLinkOptions changes which nodes GetContentLinks returns links to
+type ContentLinkOptions struct {
+	// IncludeStale returns links to nodes that haven't been heard from recently
+	IncludeStale bool `json:"include_stale"`
 
-	// Return the difference of the two
-	return contentWeNeed.Difference(contentWeHaveSet).ToSlice()
+	// Strategy is the name of the strategy used to choose and order the links,
+	// the configured default is used when it is empty
+	Strategy string `json:"strategy"`
+
+	// MaxLinks is the most links returned per file, 0 means no limit
+	MaxLinks int `json:"max_links"`
 }
 
-// GetContentLinks returns a map mapping a file name to all the places it can
-// be found on the network
-func (p *Peer) GetContentLinks(contentList []string) map[string][]string {
-	allContent := p.GetState().GetNodeFieldsMap("disk_content")
-	toReturn := make(map[string][]string)
-	for nodeAddress, diskContent := range allContent {
-		ourContent := diskContent.(*state.SignedList).Data
-		// Convert to an interface array
-		s := make([]interface{}, len(ourContent))
-		for i, v := range ourContent {
-			s[i] = v
+// GetContentLinks returns a map mapping a file name to the places it can be
+// found on the network, chosen by the strategy in opts
+func (p *Peer) GetContentLinks(contentList []string, opts ContentLinkOptions) (map[string][]string, error) {
+	if opts.Strategy == "" {
+		opts.Strategy = viper.GetString("P2P.ContentLinks.Strategy")
+	}
+	strategy, err := p.selectionStrategy(opts.Strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Work from one snapshot so every link comes from the same version of the
+	// state
+	s := p.GetState().SnapshotContent(contentList)
+	alive := make(map[string]bool)
+	candidates := make(map[string][]*LinkCandidate)
+	for _, contentWanted := range contentList {
+		if _, done := candidates[contentWanted]; done {
+			continue
 		}
-		ourContentSet := mapset.NewSetFromSlice(s)
-		// Check to see if the current node we're iterating over has any of the
-		// content we want
-		for _, contentWanted := range contentList {
-			if ourContentSet.Contains(contentWanted) {
-				if toReturn[contentWanted] == nil {
-					toReturn[contentWanted] = make([]string, 0)
-				}
-				// Add the URL to the map
-				link := p.createContentLink(nodeAddress, contentWanted)
-				if link != "" {
-					toReturn[contentWanted] = append(toReturn[contentWanted], link)
-				}
+		candidates[contentWanted] = make([]*LinkCandidate, 0)
+		for _, nodeAddress := range s.NodesWithContent(contentWanted) {
+			isAlive, checked := alive[nodeAddress]
+			if !checked {
+				isAlive = opts.IncludeStale || s.IsNodeAlive(nodeAddress, staleAfter())
+				alive[nodeAddress] = isAlive
+			}
+			if !isAlive {
+				continue
 			}
+			// Add the URL to the candidates
+			link := createContentLink(s, nodeAddress, contentWanted)
+			if link != "" {
+				candidates[contentWanted] = append(candidates[contentWanted], newLinkCandidate(s, nodeAddress, link))
+			}
+		}
+	}
+
+	toReturn := make(map[string][]string)
+	for contentWanted, c := range candidates {
+		if len(c) == 0 {
+			continue
+		}
+		links := make([]string, 0)
+		for _, selected := range strategy.Select(contentWanted, c, opts.MaxLinks) {
+			links = append(links, selected.Link)
 		}
+		toReturn[contentWanted] = links
 	}
-	return toReturn
+	return toReturn, nil
 }
 
 // Builds a URL to a node
-func (p *Peer) createContentLink(nodeAddress, contentFileName string) string {
-	nodeIP := p.GetState().GetNodeField(nodeAddress, "ip_address")
-	nodePort := p.GetState().GetNodeField(nodeAddress, "http_port")
+func createContentLink(s *state.Snapshot, nodeAddress, contentFileName string) string {
+	nodeIP := s.GetNodeField(nodeAddress, "ip_address")
+	nodePort := s.GetNodeField(nodeAddress, "http_port")
 	if nodeIP == nil || nodePort == nil {
 		return ""
 	}
@@ -225,7 +299,9 @@ func (p *Peer) createContentLink(nodeAddress, contentFileName string) string {
 	if nodeIP == nil || nodePort == nil || nodeIP == "" || nodePort == "" {
 		return ""
 	}
-	u.Host = nodeIP.(string) + ":" + nodePort.(string)
+	// The port is a number, older states may still have it as a string. IPv6
+	// addresses need brackets.
+	u.Host = net.JoinHostPort(fmt.Sprint(nodeIP), fmt.Sprint(nodePort))
 	u.Path = "/content"
 	u.Scheme = "http"
 
@@ -0,0 +1,142 @@
+package peer
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/message"
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/state"
+)
+
+// signTestMessage signs the message content with the key
+func signTestMessage(tb testing.TB, key *ecdsa.PrivateKey, content string) *signature.SignedMessage {
+	return signTestMessageAt(tb, key, content, time.Now().Unix())
+}
+
+// signTestMessageAt signs the message content with the key and timestamp
+func signTestMessageAt(tb testing.TB, key *ecdsa.PrivateKey, content string, timestamp int64) *signature.SignedMessage {
+	m := message.New([]byte(content))
+	m.Timestamp = timestamp
+	messageBytes := m.Serialize()
+	hash := crypto.Keccak256(messageBytes)
+	sig, err := crypto.Sign(hash, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	h := json.RawMessage(messageBytes)
+	return &signature.SignedMessage{Message: &h, Hash: hash, Signature: sig, Address: crypto.PubkeyToAddress(key.PublicKey).String()}
+}
+
+// newContentPeer returns a peer whose state has the number of nodes, each
+// with filesPerNode files of which every node shares the first
+func newContentPeer(tb testing.TB, nodes, filesPerNode int) *Peer {
+	mp := signature.NewMemoryProvider()
+	s := state.New()
+	s.SetMembershipProvider(mp)
+	s.RegisterNodeField("ip_address", state.FieldSchema{Type: state.TypeHost})
+	s.RegisterNodeField("http_port", state.FieldSchema{Type: state.TypePort})
+	s.RegisterNodeField("disk_content", state.FieldSchema{Type: state.TypeStringList})
+
+	for n := 0; n < nodes; n++ {
+		key, _ := crypto.GenerateKey()
+		mp.Add(crypto.PubkeyToAddress(key.PublicKey).String())
+
+		files := []string{`"site/shared"`}
+		for f := 1; f < filesPerNode; f++ {
+			files = append(files, fmt.Sprintf(`"site/%d_%d"`, n, f))
+		}
+		content := fmt.Sprintf(`{"node":{"ip_address":"10.0.%d.%d","http_port":8080,"disk_content":[%s]}}`, n/256, n%256, strings.Join(files, ","))
+
+		if err := s.UpdateState(signTestMessage(tb, key, content)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return &Peer{peerState: s, strategies: newSelectionStrategies()}
+}
+
+func TestGetContentLinks(t *testing.T) {
+	p := newContentPeer(t, 3, 2)
+	links, err := p.GetContentLinks([]string{"site/shared", "site/1_1", "site/missing"}, ContentLinkOptions{IncludeStale: true, Strategy: "random"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links["site/shared"]) != 3 {
+		t.Errorf("expected 3 links to shared content, got %v", links["site/shared"])
+	}
+	if len(links["site/1_1"]) != 1 || links["site/1_1"][0] != "http://10.0.0.1:8080/content?asset=1_1&website=site" {
+		t.Errorf("unexpected links: %v", links["site/1_1"])
+	}
+	if _, ok := links["site/missing"]; ok {
+		t.Error("got links to content no node has")
+	}
+}
+
+func TestContentLinkWithIPv6(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+	mp := signature.NewMemoryProvider()
+	mp.Add(address)
+	s := state.New()
+	s.SetMembershipProvider(mp)
+	s.RegisterNodeField("ip_address", state.FieldSchema{Type: state.TypeHost})
+	s.RegisterNodeField("http_port", state.FieldSchema{Type: state.TypePort})
+
+	if err := s.UpdateState(signTestMessage(t, key, `{"node":{"ip_address":"2001:db8::1","http_port":8080}}`)); err != nil {
+		t.Fatal(err)
+	}
+	link := createContentLink(s.Snapshot(), address, "site/index.html")
+	if link != "http://[2001:db8::1]:8080/content?asset=index.html&website=site" {
+		t.Errorf("unexpected link: %s", link)
+	}
+}
+
+func BenchmarkGetContentLinks(b *testing.B) {
+	p := newContentPeer(b, 1000, 100)
+	wanted := []string{"site/shared", "site/10_1", "site/500_50", "site/missing"}
+	opts := ContentLinkOptions{IncludeStale: true, Strategy: "random"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.GetContentLinks(wanted, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetContentLinksFullScan is the baseline for BenchmarkGetContentLinks,
+// finding the links the way it was done before the content index by checking
+// the disk_content of every node in a full snapshot
+func BenchmarkGetContentLinksFullScan(b *testing.B) {
+	p := newContentPeer(b, 1000, 100)
+	wanted := []string{"site/shared", "site/10_1", "site/500_50", "site/missing"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := p.GetState().Snapshot()
+		links := make(map[string][]string)
+		for nodeAddress, nd := range s.NodeDataMap {
+			list, ok := nd["disk_content"].(*state.SignedList)
+			if !ok {
+				continue
+			}
+			diskContent := make(map[string]bool, len(list.Data))
+			for _, item := range list.Data {
+				diskContent[item] = true
+			}
+			for _, contentWanted := range wanted {
+				if diskContent[contentWanted] {
+					if link := createContentLink(s, nodeAddress, contentWanted); link != "" {
+						links[contentWanted] = append(links[contentWanted], link)
+					}
+				}
+			}
+		}
+	}
+}
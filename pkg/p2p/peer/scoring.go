@@ -0,0 +1,308 @@
+package peer
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/legion/network"
+	"github.com/gladiusio/legion/network/message"
+	"github.com/gladiusio/legion/utils"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// offense is a kind of misbehaviour a peer is penalized for
+type offense string
+
+// The offenses peers are scored on
+const (
+	offenseMalformed  offense = "malformed"  // A body we couldn't parse
+	offenseUnverified offense = "unverified" // A state message with a bad signature
+	offenseOversized  offense = "oversized"  // A message over the size limit
+	offenseSyncFlood  offense = "sync_flood" // Too many sync requests
+)
+
+// How many points each offense adds to a peer's score
+var offensePenalties = map[offense]float64{
+	offenseMalformed:  10,
+	offenseUnverified: 20,
+	offenseOversized:  25,
+	offenseSyncFlood:  10,
+}
+
+// The most peers the scoreboard keeps records for, once it's full the records
+// with the lowest score are forgotten first
+const maxScoredPeers = 4096
+
+// scoringConfig is when peers are banned
+type scoringConfig struct {
+	// BanThreshold is the score at which a peer is banned, 0 never bans.
+	// Offenses are scored against the sender a message claims, legion doesn't
+	// tell us which connection delivered it, so anyone can run up the score of
+	// a peer we are connected to. Banning is off by default for that reason.
+	BanThreshold float64
+
+	// BanDuration is how long a peer stays banned
+	BanDuration time.Duration
+
+	// DecayPerMinute is how many points a peer's score goes down every minute
+	DecayPerMinute float64
+
+	// MaxMessageSize is the largest message body in bytes, 0 means no limit
+	MaxMessageSize int
+
+	// MaxSyncRequests is how many sync requests a peer can send per minute, 0
+	// means no limit
+	MaxSyncRequests int
+}
+
+func scoringConfigFromViper() scoringConfig {
+	return scoringConfig{
+		BanThreshold:    viper.GetFloat64("P2P.PeerScoring.BanThreshold"),
+		BanDuration:     viper.GetDuration("P2P.PeerScoring.BanDuration"),
+		DecayPerMinute:  viper.GetFloat64("P2P.PeerScoring.DecayPerMinute"),
+		MaxMessageSize:  viper.GetInt("P2P.PeerScoring.MaxMessageSize"),
+		MaxSyncRequests: viper.GetInt("P2P.PeerScoring.MaxSyncRequestsPerMinute"),
+	}
+}
+
+// PeerScore is how much a remote peer has misbehaved
+type PeerScore struct {
+	Address     string            `json:"address"`
+	Score       float64           `json:"score"`
+	Offenses    map[string]uint64 `json:"offenses"`
+	LastOffense int64             `json:"last_offense,omitempty"`
+	Banned      bool              `json:"banned"`
+	BannedUntil int64             `json:"banned_until,omitempty"`
+}
+
+type peerRecord struct {
+	score       float64
+	updated     time.Time
+	offenses    map[offense]uint64
+	lastOffense time.Time
+
+	// Sync requests in the current minute
+	syncWindow   time.Time
+	syncRequests int
+}
+
+// scoreboard keeps the score of every peer that has misbehaved, and bans the
+// ones that cross the threshold
+type scoreboard struct {
+	config scoringConfig
+	peers  map[utils.LegionAddress]*peerRecord
+	bans   map[utils.LegionAddress]time.Time
+
+	// Called when a peer is banned so it can be disconnected
+	onBan func(utils.LegionAddress)
+
+	// isConnected returns true if we have a connection to the address, only
+	// those addresses are scored. nil means every address is.
+	isConnected func(utils.LegionAddress) bool
+
+	mux sync.Mutex
+}
+
+func newScoreboard(config scoringConfig, onBan func(utils.LegionAddress)) *scoreboard {
+	return &scoreboard{
+		config: config,
+		peers:  make(map[utils.LegionAddress]*peerRecord),
+		bans:   make(map[utils.LegionAddress]time.Time),
+		onBan:  onBan,
+	}
+}
+
+func (sb *scoreboard) connected(addr utils.LegionAddress) bool {
+	return sb.isConnected == nil || sb.isConnected(addr)
+}
+
+// record returns the peer's record with its score decayed to now
+func (sb *scoreboard) record(addr utils.LegionAddress, now time.Time) *peerRecord {
+	r, ok := sb.peers[addr]
+	if !ok {
+		if len(sb.peers) >= maxScoredPeers {
+			sb.sweep(now)
+		}
+		r = &peerRecord{updated: now, offenses: make(map[offense]uint64)}
+		sb.peers[addr] = r
+	}
+	r.score -= now.Sub(r.updated).Minutes() * sb.config.DecayPerMinute
+	if r.score < 0 {
+		r.score = 0
+	}
+	r.updated = now
+	return r
+}
+
+// sweep forgets expired bans and peers with no score left. If that isn't
+// enough to make room the unbanned peer with the lowest score is forgotten.
+func (sb *scoreboard) sweep(now time.Time) {
+	for addr := range sb.bans {
+		sb.isBanned(addr, now)
+	}
+
+	var lowest utils.LegionAddress
+	lowestScore := -1.0
+	for addr, r := range sb.peers {
+		if sb.isBanned(addr, now) {
+			continue
+		}
+		score := r.score - now.Sub(r.updated).Minutes()*sb.config.DecayPerMinute
+		if score <= 0 {
+			delete(sb.peers, addr)
+			continue
+		}
+		if lowestScore < 0 || score < lowestScore {
+			lowest, lowestScore = addr, score
+		}
+	}
+	if len(sb.peers) >= maxScoredPeers && lowestScore >= 0 {
+		delete(sb.peers, lowest)
+	}
+}
+
+// Penalize adds the offense to the peer's score and bans it if it crossed the
+// threshold. Returns true if the peer was banned. Addresses we aren't
+// connected to aren't scored, so made up senders can't fill the scoreboard.
+func (sb *scoreboard) Penalize(addr utils.LegionAddress, o offense) bool {
+	if !sb.connected(addr) {
+		return false
+	}
+
+	now := time.Now()
+	sb.mux.Lock()
+	r := sb.record(addr, now)
+	r.score += offensePenalties[o]
+	r.offenses[o]++
+	r.lastOffense = now
+
+	banned := false
+	if sb.config.BanThreshold > 0 && r.score >= sb.config.BanThreshold && !sb.isBanned(addr, now) {
+		sb.bans[addr] = now.Add(sb.config.BanDuration)
+		banned = true
+	}
+	sb.mux.Unlock()
+
+	log.Debug().Str("peer", addr.String()).Str("offense", string(o)).Msg("Penalized peer")
+	if banned {
+		log.Warn().Str("peer", addr.String()).Dur("duration", sb.config.BanDuration).Msg("Banned misbehaving peer")
+		if sb.onBan != nil {
+			// Not called in place, this can be run from the connection's
+			// message loop
+			go sb.onBan(addr)
+		}
+	}
+	return banned
+}
+
+// IsBanned returns true if the peer is currently banned
+func (sb *scoreboard) IsBanned(addr utils.LegionAddress) bool {
+	sb.mux.Lock()
+	defer sb.mux.Unlock()
+	return sb.isBanned(addr, time.Now())
+}
+
+func (sb *scoreboard) isBanned(addr utils.LegionAddress, now time.Time) bool {
+	until, ok := sb.bans[addr]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(sb.bans, addr)
+		return false
+	}
+	return true
+}
+
+// AllowSync returns false, and penalizes the peer, if it has sent more sync
+// requests this minute than allowed
+func (sb *scoreboard) AllowSync(addr utils.LegionAddress) bool {
+	if sb.config.MaxSyncRequests <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	sb.mux.Lock()
+	r := sb.record(addr, now)
+	if now.Sub(r.syncWindow) >= time.Minute {
+		r.syncWindow = now
+		r.syncRequests = 0
+	}
+	r.syncRequests++
+	allowed := r.syncRequests <= sb.config.MaxSyncRequests
+	sb.mux.Unlock()
+
+	if !allowed {
+		sb.Penalize(addr, offenseSyncFlood)
+	}
+	return allowed
+}
+
+// ValidateMessage is used as the legion message validator, it drops messages
+// from banned peers and oversized messages, penalizing the sender for the
+// latter. The sender is only what the message claims, so the penalty is
+// skipped for addresses we aren't connected to.
+func (sb *scoreboard) ValidateMessage(m *message.Message) bool {
+	sender := m.Sender()
+	if sb.IsBanned(sender) {
+		return false
+	}
+	if sb.config.MaxMessageSize > 0 && len(m.Body()) > sb.config.MaxMessageSize {
+		sb.Penalize(sender, offenseOversized)
+		return false
+	}
+	return true
+}
+
+// Scores returns the score of every peer that has misbehaved, sorted by
+// address. Peers whose score has decayed to 0 and aren't banned are forgotten.
+func (sb *scoreboard) Scores() []PeerScore {
+	now := time.Now()
+	sb.mux.Lock()
+	defer sb.mux.Unlock()
+
+	scores := make([]PeerScore, 0, len(sb.peers))
+	for addr := range sb.peers {
+		r := sb.record(addr, now)
+		banned := sb.isBanned(addr, now)
+		if r.score == 0 && !banned {
+			delete(sb.peers, addr)
+			continue
+		}
+
+		ps := PeerScore{
+			Address:     addr.String(),
+			Score:       r.score,
+			Offenses:    make(map[string]uint64, len(r.offenses)),
+			LastOffense: r.lastOffense.Unix(),
+			Banned:      banned,
+		}
+		for o, count := range r.offenses {
+			ps.Offenses[string(o)] = count
+		}
+		if banned {
+			ps.BannedUntil = sb.bans[addr].Unix()
+		}
+		scores = append(scores, ps)
+	}
+
+	sort.Slice(scores, func(i, j int) bool { return scores[i].Address < scores[j].Address })
+	return scores
+}
+
+// GetPeerScores returns the score of every peer that has misbehaved, and
+// whether it is banned
+func (p *Peer) GetPeerScores() []PeerScore {
+	return p.statePlugin.scores.Scores()
+}
+
+// disconnectBanned closes the connection to a banned peer
+func disconnectBanned(l *network.Legion) func(utils.LegionAddress) {
+	return func(addr utils.LegionAddress) {
+		if err := l.DeletePeer(addr); err != nil {
+			log.Debug().Err(err).Str("peer", addr.String()).Msg("Error disconnecting banned peer")
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package peer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/legion/network/message"
+	"github.com/gladiusio/legion/utils"
+)
+
+func testScoringConfig() scoringConfig {
+	return scoringConfig{
+		BanThreshold:    45,
+		BanDuration:     time.Hour,
+		DecayPerMinute:  10,
+		MaxMessageSize:  16,
+		MaxSyncRequests: 2,
+	}
+}
+
+func TestScoreboardBansAtThreshold(t *testing.T) {
+	bannedPeers := make(chan utils.LegionAddress, 1)
+	sb := newScoreboard(testScoringConfig(), func(addr utils.LegionAddress) { bannedPeers <- addr })
+	bad := utils.NewLegionAddress("10.0.0.1", 7947)
+
+	if sb.Penalize(bad, offenseUnverified) || sb.Penalize(bad, offenseUnverified) {
+		t.Fatal("peer was banned below the threshold")
+	}
+	if !sb.Penalize(bad, offenseMalformed) {
+		t.Fatal("peer wasn't banned at the threshold")
+	}
+	if addr := <-bannedPeers; addr != bad {
+		t.Errorf("wrong peer disconnected: %s", addr)
+	}
+	if !sb.IsBanned(bad) || sb.IsBanned(utils.NewLegionAddress("10.0.0.2", 7947)) {
+		t.Error("ban list is wrong")
+	}
+
+	scores := sb.Scores()
+	if len(scores) != 1 || !scores[0].Banned || scores[0].Offenses["unverified"] != 2 {
+		t.Errorf("unexpected scores: %+v", scores)
+	}
+}
+
+func TestScoreboardDecays(t *testing.T) {
+	sb := newScoreboard(testScoringConfig(), nil)
+	addr := utils.NewLegionAddress("10.0.0.1", 7947)
+	sb.Penalize(addr, offenseUnverified)
+	sb.Penalize(addr, offenseUnverified)
+
+	// Pretend the offenses were three minutes ago
+	sb.peers[addr].updated = time.Now().Add(-3 * time.Minute)
+	if sb.Penalize(addr, offenseMalformed) {
+		t.Error("peer was banned after its score decayed")
+	}
+
+	sb.peers[addr].updated = time.Now().Add(-time.Hour)
+	if scores := sb.Scores(); len(scores) != 0 {
+		t.Errorf("peer with no score left wasn't forgotten: %+v", scores)
+	}
+}
+
+func TestScoreboardLimitsSyncRequests(t *testing.T) {
+	sb := newScoreboard(testScoringConfig(), nil)
+	addr := utils.NewLegionAddress("10.0.0.1", 7947)
+	if !sb.AllowSync(addr) || !sb.AllowSync(addr) {
+		t.Fatal("sync request under the limit was refused")
+	}
+	if sb.AllowSync(addr) {
+		t.Error("sync request over the limit was allowed")
+	}
+	if scores := sb.Scores(); len(scores) != 1 || scores[0].Offenses["sync_flood"] != 1 {
+		t.Errorf("sync flood wasn't penalized: %+v", scores)
+	}
+}
+
+func TestScoreboardValidatesMessages(t *testing.T) {
+	sb := newScoreboard(testScoringConfig(), nil)
+	sender := utils.NewLegionAddress("10.0.0.1", 7947)
+
+	if !sb.ValidateMessage(message.New(sender, "state_update", []byte("{}"), []byte{})) {
+		t.Error("small message was dropped")
+	}
+	if sb.ValidateMessage(message.New(sender, "state_update", make([]byte, 17), []byte{})) {
+		t.Error("oversized message was accepted")
+	}
+
+	sb.bans[sender] = time.Now().Add(time.Minute)
+	if sb.ValidateMessage(message.New(sender, "state_update", []byte("{}"), []byte{})) {
+		t.Error("message from a banned peer was accepted")
+	}
+}
+
+func TestScoreboardOnlyScoresConnectedPeers(t *testing.T) {
+	connected := utils.NewLegionAddress("10.0.0.1", 7947)
+	spoofed := utils.NewLegionAddress("10.0.0.2", 7947)
+	sb := newScoreboard(testScoringConfig(), nil)
+	sb.isConnected = func(addr utils.LegionAddress) bool { return addr == connected }
+
+	// The advertised address of a peer can differ from the one we dialed, so
+	// its messages still have to get through
+	if !sb.ValidateMessage(message.New(spoofed, "state_update", []byte("{}"), []byte{})) {
+		t.Error("message from an address we aren't connected to was dropped")
+	}
+
+	for i := 0; i < 5; i++ {
+		sb.ValidateMessage(message.New(spoofed, "state_update", make([]byte, 17), []byte{}))
+	}
+	sb.Penalize(connected, offenseMalformed)
+	if scores := sb.Scores(); len(scores) != 1 || scores[0].Address != connected.String() {
+		t.Errorf("address we aren't connected to was scored: %+v", scores)
+	}
+}
+
+func TestScoreboardIsBounded(t *testing.T) {
+	sb := newScoreboard(testScoringConfig(), nil)
+	for i := 0; i <= maxScoredPeers; i++ {
+		sb.Penalize(utils.NewLegionAddress(fmt.Sprintf("10.1.%d.%d", i/256, i%256), 7947), offenseMalformed)
+	}
+	if len(sb.peers) > maxScoredPeers {
+		t.Errorf("expected at most %d records, got %d", maxScoredPeers, len(sb.peers))
+	}
+}
@@ -0,0 +1,194 @@
+package peer
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/state"
+)
+
+// LinkCandidate is a node that has a requested file
+type LinkCandidate struct {
+	Address   string
+	Link      string
+	Heartbeat int64   // Timestamp of the node's latest heartbeat message
+	Capacity  float64 // Advertised capacity, used as a weight
+}
+
+// SelectionStrategy picks which of the nodes holding a file are returned as
+// links, and in which order
+type SelectionStrategy interface {
+	Select(content string, candidates []*LinkCandidate, max int) []*LinkCandidate
+}
+
+// limit returns at most max candidates, max <= 0 means no limit
+func limit(candidates []*LinkCandidate, max int) []*LinkCandidate {
+	if max > 0 && len(candidates) > max {
+		return candidates[:max]
+	}
+	return candidates
+}
+
+// randomStrategy returns the nodes in a random order
+type randomStrategy struct{}
+
+func (randomStrategy) Select(content string, candidates []*LinkCandidate, max int) []*LinkCandidate {
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	return limit(candidates, max)
+}
+
+// roundRobinStrategy starts each request for a file one node further along
+// than the last one
+type roundRobinStrategy struct {
+	next map[string]int
+	mux  sync.Mutex
+}
+
+func (rr *roundRobinStrategy) Select(content string, candidates []*LinkCandidate, max int) []*LinkCandidate {
+	if len(candidates) == 0 {
+		return candidates
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Address < candidates[j].Address })
+
+	rr.mux.Lock()
+	start := rr.next[content] % len(candidates)
+	rr.next[content] = start + 1
+	rr.mux.Unlock()
+
+	rotated := make([]*LinkCandidate, 0, len(candidates))
+	rotated = append(rotated, candidates[start:]...)
+	rotated = append(rotated, candidates[:start]...)
+	return limit(rotated, max)
+}
+
+// leastRecentStrategy prefers the nodes we handed out the longest time ago
+type leastRecentStrategy struct {
+	returned map[string]time.Time
+	mux      sync.Mutex
+}
+
+func (lr *leastRecentStrategy) Select(content string, candidates []*LinkCandidate, max int) []*LinkCandidate {
+	lr.mux.Lock()
+	defer lr.mux.Unlock()
+
+	// Shuffle first so nodes that have never been returned aren't always in
+	// the same order
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return lr.returned[candidates[i].Address].Before(lr.returned[candidates[j].Address])
+	})
+
+	selected := limit(candidates, max)
+	now := time.Now()
+	for _, c := range selected {
+		lr.returned[c.Address] = now
+	}
+	return selected
+}
+
+// freshestStrategy prefers the nodes with the most recent heartbeat
+type freshestStrategy struct{}
+
+func (freshestStrategy) Select(content string, candidates []*LinkCandidate, max int) []*LinkCandidate {
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Heartbeat > candidates[j].Heartbeat })
+	return limit(candidates, max)
+}
+
+// weightedStrategy picks nodes at random, weighted by their advertised
+// capacity. Nodes that don't advertise one are rarely picked.
+type weightedStrategy struct{}
+
+func (weightedStrategy) Select(content string, candidates []*LinkCandidate, max int) []*LinkCandidate {
+	remaining := append([]*LinkCandidate{}, candidates...)
+	selected := make([]*LinkCandidate, 0, len(candidates))
+
+	for len(remaining) > 0 && (max <= 0 || len(selected) < max) {
+		total := 0.0
+		for _, c := range remaining {
+			total += weightOf(c)
+		}
+
+		// Weighted pick without replacement
+		r := rand.Float64() * total
+		i := 0
+		for ; i < len(remaining)-1; i++ {
+			r -= weightOf(remaining[i])
+			if r < 0 {
+				break
+			}
+		}
+		selected = append(selected, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+
+	return selected
+}
+
+func weightOf(c *LinkCandidate) float64 {
+	if c.Capacity <= 0 {
+		return 0.01
+	}
+	return c.Capacity
+}
+
+// newSelectionStrategies returns every strategy by the name used to request it
+func newSelectionStrategies() map[string]SelectionStrategy {
+	return map[string]SelectionStrategy{
+		"random":       randomStrategy{},
+		"round_robin":  &roundRobinStrategy{next: make(map[string]int)},
+		"least_recent": &leastRecentStrategy{returned: make(map[string]time.Time)},
+		"freshest":     freshestStrategy{},
+		"weighted":     weightedStrategy{},
+	}
+}
+
+// RegisterSelectionStrategy adds a strategy that can be requested by name
+// from GetContentLinks, replacing any strategy with the same name
+func (p *Peer) RegisterSelectionStrategy(name string, strategy SelectionStrategy) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.strategies[name] = strategy
+}
+
+// selectionStrategy returns the strategy with the given name
+func (p *Peer) selectionStrategy(name string) (SelectionStrategy, error) {
+	p.mux.Lock()
+	strategy, ok := p.strategies[name]
+	p.mux.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown content link strategy: %s", name)
+	}
+	return strategy, nil
+}
+
+// newLinkCandidate collects what the strategies need to know about a node
+func newLinkCandidate(s *state.Snapshot, nodeAddress, link string) *LinkCandidate {
+	c := &LinkCandidate{Address: nodeAddress, Link: link}
+
+	if heartbeat, ok := s.GetNodeField(nodeAddress, "heartbeat").(*state.SignedField); ok {
+		c.Heartbeat = heartbeat.SignedMessage.GetTimestamp()
+	}
+	if capacity, ok := s.GetNodeField(nodeAddress, "capacity").(*state.SignedField); ok {
+		c.Capacity = capacityWeight(capacity.Data)
+	}
+
+	return c
+}
+
+// capacityWeight returns the weight of a capacity field, which is either a
+// number or an object with a "weight" number. Anything else has no weight.
+func capacityWeight(data interface{}) float64 {
+	if object, ok := data.(map[string]interface{}); ok {
+		data = object["weight"]
+	}
+	switch data.(type) {
+	case nil, bool, map[string]interface{}, []interface{}:
+		return 0
+	}
+	weight, _ := strconv.ParseFloat(fmt.Sprint(data), 64)
+	return weight
+}
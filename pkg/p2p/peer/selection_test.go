@@ -0,0 +1,85 @@
+package peer
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func testCandidates() []*LinkCandidate {
+	return []*LinkCandidate{
+		{Address: "a", Link: "http://a", Heartbeat: 100},
+		{Address: "b", Link: "http://b", Heartbeat: 300, Capacity: 1000},
+		{Address: "c", Link: "http://c", Heartbeat: 200},
+	}
+}
+
+func TestRoundRobinRotates(t *testing.T) {
+	rr := newSelectionStrategies()["round_robin"]
+
+	first := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		selected := rr.Select("site/file", testCandidates(), 1)
+		if len(selected) != 1 {
+			t.Fatalf("expected 1 link, got %d", len(selected))
+		}
+		first = append(first, selected[0].Address)
+	}
+
+	expected := []string{"a", "b", "c", "a"}
+	for i := range expected {
+		if first[i] != expected[i] {
+			t.Fatalf("expected rotation %v, got %v", expected, first)
+		}
+	}
+}
+
+func TestFreshestPrefersNewestHeartbeat(t *testing.T) {
+	selected := newSelectionStrategies()["freshest"].Select("site/file", testCandidates(), 2)
+	if len(selected) != 2 || selected[0].Address != "b" || selected[1].Address != "c" {
+		t.Errorf("unexpected selection: %v %v", selected[0], selected[1])
+	}
+}
+
+func TestLeastRecentSpreadsLinks(t *testing.T) {
+	lr := newSelectionStrategies()["least_recent"]
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		for _, c := range lr.Select("site/file", testCandidates(), 1) {
+			seen[c.Address] = true
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected every node to be returned once, got %v", seen)
+	}
+}
+
+func TestWeightedReturnsEveryNodeOnce(t *testing.T) {
+	selected := newSelectionStrategies()["weighted"].Select("site/file", testCandidates(), 0)
+	seen := make(map[string]bool)
+	for _, c := range selected {
+		seen[c.Address] = true
+	}
+	if len(selected) != 3 || len(seen) != 3 {
+		t.Errorf("expected all 3 nodes without repeats, got %d", len(selected))
+	}
+}
+
+func TestCapacityWeight(t *testing.T) {
+	tests := []struct {
+		data   interface{}
+		weight float64
+	}{
+		{json.Number("250"), 250},
+		{"12.5", 12.5},
+		{map[string]interface{}{"weight": json.Number("40"), "disk": json.Number("500")}, 40},
+		{map[string]interface{}{"disk": json.Number("500")}, 0},
+		{[]interface{}{json.Number("1")}, 0},
+		{true, 0},
+		{nil, 0},
+	}
+	for _, tt := range tests {
+		if weight := capacityWeight(tt.data); weight != tt.weight {
+			t.Errorf("capacityWeight(%#v) = %v, expected %v", tt.data, weight, tt.weight)
+		}
+	}
+}
@@ -3,75 +3,226 @@ package peer
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/buger/jsonparser"
 	"github.com/rs/zerolog/log"
 
 	"github.com/gladiusio/legion/network"
+	"github.com/gladiusio/legion/utils"
 
 	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
 	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/state"
 )
 
+// How long we wait for a peer to answer a digest before we assume it doesn't
+// understand them and ask it for the full signature list instead
+const digestReplyTimeout = 10 * time.Second
+
 // StatePlugin handles incoming messages related to the network state
 type StatePlugin struct {
 	network.GenericPlugin
 	peerState *state.State
+	l         *network.Legion
+
+	// Peers we've sent a digest to and haven't heard back from yet
+	pendingDigests map[utils.LegionAddress]bool
+
+	// Consistency checks waiting for fingerprint replies
+	fingerprintWaiters map[chan fingerprintReply]bool
+
+	// Recently handled state updates and how far they are relayed
+	seen   *seenCache
+	gossip gossipConfig
+
+	// Workers that verify and apply received state messages
+	verifier *verifier
+
+	// Misbehaving peers
+	scores *scoreboard
+
+	mux sync.Mutex
 }
 
 // NewMessage is called every time a new message is received
 func (state *StatePlugin) NewMessage(ctx *network.MessageContext) {
 	switch ctx.Message.Type() {
 	case "state_update":
-		sm, err := parseSignedMessage(ctx.Message.Body())
-		if err == nil {
-			go state.peerState.UpdateState(sm)
-		} else {
-			fmt.Println(err)
-		}
+		state.handleStateUpdate(ctx)
 	case "sync_request":
+		if !state.scores.AllowSync(ctx.Sender) {
+			return
+		}
+		// Full list reply, kept for peers that don't support digests
 		smList := state.peerState.GetSignatureList()
 		b, err := json.Marshal(smList)
 		if err != nil {
 			return
 		}
 		ctx.Reply(ctx.Legion.NewMessage("sync_response", b))
+	case "sync_digest", "sync_digest_reply":
+		// Replies are limited too, anyone can send one without being asked
+		if !state.scores.AllowSync(ctx.Sender) {
+			return
+		}
+		d, err := parseDigest(ctx.Message.Body())
+		if err != nil {
+			log.Warn().Err(err).Str("sender", ctx.Sender.String()).Msg("Malformed state digest")
+			state.scores.Penalize(ctx.Sender, offenseMalformed)
+			return
+		}
+
+		// Send back only what they are missing
+		b, err := json.Marshal(state.peerState.GetSignatureListNewerThan(d))
+		if err != nil {
+			return
+		}
+		ctx.Reply(ctx.Legion.NewMessage("sync_response", b))
+
+		// If they have something we don't, send them our digest so they can
+		// do the same for us. Replies are never answered with a digest so this
+		// can't bounce back and forth.
+		if ctx.Message.Type() == "sync_digest" && state.peerState.IsBehind(d) {
+			b, err := json.Marshal(state.peerState.GetDigest())
+			if err != nil {
+				return
+			}
+			ctx.Reply(ctx.Legion.NewMessage("sync_digest_reply", b))
+		}
+	case "fingerprint_request":
+		fp := state.peerState.Fingerprint()
+		ctx.Reply(ctx.Legion.NewMessage("fingerprint_reply", fingerprintMessageBody(fp)))
+	case "fingerprint_reply":
+		state.handleFingerprintReply(ctx)
 	case "sync_response":
+		state.mux.Lock()
+		delete(state.pendingDigests, ctx.Sender)
+		state.mux.Unlock()
+
 		smListBytes := ctx.Message.Body()
-		jsonparser.ArrayEach(smListBytes, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		malformed := false
+		dropped := 0
+		_, err := jsonparser.ArrayEach(smListBytes, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
 			sm, err := parseSignedMessage(value)
 			if err != nil {
+				malformed = true
 				return
 			}
-			go func() {
-				err := state.peerState.UpdateState(sm)
-				if err != nil {
-					log.Error().Err(err).Msg("Error updating state from sync_response")
-				}
-			}()
+			if state.seen.Has(sm.Hash) {
+				return
+			}
+			// Sync replies repair our own state and aren't relayed
+			if !state.verifier.SubmitSync(&verifyJob{sm: sm, sender: ctx.Sender}) {
+				dropped++
+			}
 		})
+		if err != nil || malformed {
+			state.scores.Penalize(ctx.Sender, offenseMalformed)
+		}
+		if dropped > 0 {
+			log.Debug().Int("dropped", dropped).Str("sender", ctx.Sender.String()).Msg("Verify queue full, dropped messages from sync reply")
+		}
 	}
 }
 
 // Startup is called once the network is started. Every 60
-// seconds we ask a random peer for it's state. This is an anti
+// seconds we ask a random peer for anything we're missing. This is an anti
 // entropy method that might not be entirely needed.
 func (state *StatePlugin) Startup(ctx *network.NetworkContext) {
 	go func() {
 		for {
 			time.Sleep(60 * time.Second)
-			ctx.Legion.BroadcastRandom(ctx.Legion.NewMessage("sync_request", []byte{}), 1)
+			state.requestSync(randomPromotedPeer(ctx.Legion)...)
+		}
+	}()
+}
+
+// requestSync sends our digest to the given peers so they reply with the
+// messages we're missing. Peers that don't answer are asked for their full
+// signature list instead.
+func (state *StatePlugin) requestSync(addrs ...utils.LegionAddress) {
+	if len(addrs) == 0 {
+		return
+	}
+	l := state.l
+
+	b, err := json.Marshal(state.peerState.GetDigest())
+	if err != nil {
+		return
+	}
+
+	state.mux.Lock()
+	if state.pendingDigests == nil {
+		state.pendingDigests = make(map[utils.LegionAddress]bool)
+	}
+	for _, addr := range addrs {
+		state.pendingDigests[addr] = true
+	}
+	state.mux.Unlock()
+
+	l.Broadcast(l.NewMessage("sync_digest", b), addrs...)
+
+	go func() {
+		time.Sleep(digestReplyTimeout)
+
+		fallback := make([]utils.LegionAddress, 0)
+		state.mux.Lock()
+		for _, addr := range addrs {
+			if state.pendingDigests[addr] {
+				fallback = append(fallback, addr)
+				delete(state.pendingDigests, addr)
+			}
+		}
+		state.mux.Unlock()
+
+		if len(fallback) > 0 {
+			log.Debug().Int("peers", len(fallback)).Msg("No reply to state digest, falling back to full sync")
+			l.Broadcast(l.NewMessage("sync_request", []byte{}), fallback...)
 		}
 	}()
 }
 
+// randomPromotedPeer returns a random promoted peer, or nothing if we aren't
+// connected to anyone
+func randomPromotedPeer(l *network.Legion) []utils.LegionAddress {
+	addrs := make([]utils.LegionAddress, 0)
+	l.DoPromotedPeers(func(p *network.Peer) { addrs = append(addrs, p.Remote()) })
+	if len(addrs) == 0 {
+		return addrs
+	}
+	i := rand.Intn(len(addrs))
+	return addrs[i : i+1]
+}
+
 // PeerAdded is called when a new peer connects or is added
 func (state *StatePlugin) PeerAdded(ctx *network.PeerContext) {
+	if state.scores.IsBanned(ctx.Peer.Remote()) {
+		ctx.Legion.DeletePeer(ctx.Peer.Remote())
+		return
+	}
+	// An incoming connection is stored under the sender of its first message,
+	// if another connection already has that address this one is pretending
+	// to be it
+	if ctx.IsIncoming && !isStoredConnection(ctx.Legion, ctx.Peer) {
+		log.Warn().Str("peer", ctx.Peer.Remote().String()).Msg("Closing connection claiming the address of another peer")
+		ctx.Peer.Close()
+		return
+	}
 	ctx.Legion.PromotePeer(ctx.Peer.Remote())
 }
 
+// isStoredConnection returns true if p is the connection legion has stored for
+// its address
+func isStoredConnection(l *network.Legion, p *network.Peer) bool {
+	stored := false
+	l.DoAllPeers(func(other *network.Peer) {
+		stored = stored || other == p
+	})
+	return stored
+}
+
 func parseSignedMessage(smBytes []byte) (*signature.SignedMessage, error) {
 	messageBytes, _, _, err := jsonparser.Get(smBytes, "message")
 	if err != nil {
@@ -102,3 +253,12 @@ func parseSignedMessage(smBytes []byte) (*signature.SignedMessage, error) {
 
 	return parsed, nil
 }
+
+func parseDigest(digestBytes []byte) (*state.Digest, error) {
+	d := &state.Digest{}
+	err := json.Unmarshal(digestBytes, d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
@@ -0,0 +1,264 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/legion/network"
+	"github.com/gladiusio/legion/utils"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/state"
+)
+
+// ConnectedPeer is a legion peer we have a connection to
+type ConnectedPeer struct {
+	Address  string `json:"address"`
+	Promoted bool   `json:"promoted"`
+	Incoming bool   `json:"incoming"`
+
+	// ConnectedAt is when we first saw the connection, and ConnectedFor how
+	// many seconds ago that was
+	ConnectedAt  int64 `json:"connected_at"`
+	ConnectedFor int64 `json:"connected_for"`
+
+	LastMessage int64  `json:"last_message,omitempty"`
+	Messages    uint64 `json:"messages"`
+
+	// WalletAddresses are the nodes in the state whose ip_address matches the
+	// peer's host, only filled in when asked for
+	WalletAddresses []string `json:"wallet_addresses,omitempty"`
+}
+
+// DiscoveredPeer is a peer address another peer told us about
+type DiscoveredPeer struct {
+	Address      string `json:"address"`
+	From         string `json:"from"`
+	DiscoveredAt int64  `json:"discovered_at"`
+	Connected    bool   `json:"connected"`
+}
+
+// The most connections and discovered addresses the topology plugin keeps,
+// once a table is full its oldest entry is replaced
+const maxTopologyEntries = 4096
+
+type connectionInfo struct {
+	connected   time.Time
+	incoming    bool
+	lastMessage time.Time
+	messages    uint64
+}
+
+type discoveryEntry struct {
+	from       utils.LegionAddress
+	discovered time.Time
+}
+
+// TopologyPlugin keeps track of when peers connected and last sent us a
+// message, and of the peer lists the discovery plugin receives, since legion
+// and simpledisc don't keep either
+type TopologyPlugin struct {
+	network.GenericPlugin
+
+	connections map[utils.LegionAddress]*connectionInfo
+	discovered  map[utils.LegionAddress]*discoveryEntry
+
+	mux sync.Mutex
+}
+
+func newTopologyPlugin() *TopologyPlugin {
+	return &TopologyPlugin{
+		connections: make(map[utils.LegionAddress]*connectionInfo),
+		discovered:  make(map[utils.LegionAddress]*discoveryEntry),
+	}
+}
+
+// NewMessage records when the sender last sent a message, and the addresses
+// in discovery messages
+func (tp *TopologyPlugin) NewMessage(ctx *network.MessageContext) {
+	tp.recordMessage(ctx.Sender, ctx.Message.Type(), ctx.Message.Body(), time.Now())
+}
+
+// PeerAdded records when the peer connected
+func (tp *TopologyPlugin) PeerAdded(ctx *network.PeerContext) {
+	tp.recordConnected(ctx.Peer.Remote(), ctx.IsIncoming, time.Now())
+}
+
+// PeerDisconnect forgets the connection
+func (tp *TopologyPlugin) PeerDisconnect(ctx *network.PeerContext) {
+	tp.mux.Lock()
+	defer tp.mux.Unlock()
+	delete(tp.connections, ctx.Peer.Remote())
+}
+
+// connection returns the info for the address, creating it if needed. The
+// first message from an incoming peer can arrive before it is added.
+func (tp *TopologyPlugin) connection(addr utils.LegionAddress, now time.Time) *connectionInfo {
+	info, ok := tp.connections[addr]
+	if !ok {
+		if len(tp.connections) >= maxTopologyEntries {
+			tp.forgetOldestConnection()
+		}
+		info = &connectionInfo{connected: now}
+		tp.connections[addr] = info
+	}
+	return info
+}
+
+func (tp *TopologyPlugin) forgetOldestConnection() {
+	var oldest utils.LegionAddress
+	var oldestTime time.Time
+	for addr, info := range tp.connections {
+		if oldestTime.IsZero() || info.connected.Before(oldestTime) {
+			oldest, oldestTime = addr, info.connected
+		}
+	}
+	delete(tp.connections, oldest)
+}
+
+func (tp *TopologyPlugin) recordDiscovered(addr, from utils.LegionAddress, now time.Time) {
+	if _, ok := tp.discovered[addr]; !ok && len(tp.discovered) >= maxTopologyEntries {
+		var oldest utils.LegionAddress
+		var oldestTime time.Time
+		for a, entry := range tp.discovered {
+			if oldestTime.IsZero() || entry.discovered.Before(oldestTime) {
+				oldest, oldestTime = a, entry.discovered
+			}
+		}
+		delete(tp.discovered, oldest)
+	}
+	tp.discovered[addr] = &discoveryEntry{from: from, discovered: now}
+}
+
+func (tp *TopologyPlugin) recordConnected(addr utils.LegionAddress, incoming bool, now time.Time) {
+	tp.mux.Lock()
+	defer tp.mux.Unlock()
+	tp.connection(addr, now).incoming = incoming
+}
+
+func (tp *TopologyPlugin) recordMessage(sender utils.LegionAddress, messageType string, body []byte, now time.Time) {
+	tp.mux.Lock()
+	defer tp.mux.Unlock()
+
+	info := tp.connection(sender, now)
+	info.lastMessage = now
+	info.messages++
+
+	// The same messages simpledisc connects to new peers from
+	addrs := make([]string, 0)
+	switch messageType {
+	case "peer_list":
+		json.Unmarshal(body, &addrs)
+	case "new_peer":
+		addrs = append(addrs, string(body))
+	}
+	for _, a := range addrs {
+		if addr, ok := parseLegionAddress(a); ok {
+			tp.recordDiscovered(addr, sender, now)
+		}
+	}
+}
+
+// parseLegionAddress parses a host:port address, legion panics on strings
+// without a port so they are checked first
+func parseLegionAddress(s string) (utils.LegionAddress, bool) {
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return utils.LegionAddress{}, false
+	}
+	addr := utils.LegionAddressFromString(s)
+	return addr, addr.IsValid()
+}
+
+// connected returns the peers with the info we've recorded about them, sorted
+// by address
+func (tp *TopologyPlugin) connected(remotes []utils.LegionAddress, isPromoted func(utils.LegionAddress) bool, now time.Time) []ConnectedPeer {
+	tp.mux.Lock()
+	defer tp.mux.Unlock()
+
+	peers := make([]ConnectedPeer, 0, len(remotes))
+	for _, addr := range remotes {
+		info := tp.connection(addr, now)
+		cp := ConnectedPeer{
+			Address:      addr.String(),
+			Promoted:     isPromoted(addr),
+			Incoming:     info.incoming,
+			ConnectedAt:  info.connected.Unix(),
+			ConnectedFor: int64(now.Sub(info.connected).Seconds()),
+			Messages:     info.messages,
+		}
+		if !info.lastMessage.IsZero() {
+			cp.LastMessage = info.lastMessage.Unix()
+		}
+		peers = append(peers, cp)
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	return peers
+}
+
+// discoveryTable returns every address we've been told about, sorted by
+// address
+func (tp *TopologyPlugin) discoveryTable(isConnected func(utils.LegionAddress) bool) []DiscoveredPeer {
+	tp.mux.Lock()
+	defer tp.mux.Unlock()
+
+	peers := make([]DiscoveredPeer, 0, len(tp.discovered))
+	for addr, entry := range tp.discovered {
+		peers = append(peers, DiscoveredPeer{
+			Address:      addr.String(),
+			From:         entry.from.String(),
+			DiscoveredAt: entry.discovered.Unix(),
+			Connected:    isConnected(addr),
+		})
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	return peers
+}
+
+// walletsByHost maps the ip_address of every node in the state to the node
+// addresses using it
+func walletsByHost(snap *state.Snapshot) map[string][]string {
+	wallets := make(map[string][]string)
+	for node, field := range snap.GetNodeFieldsMap("ip_address") {
+		if f, ok := field.(*state.SignedField); ok {
+			host := fmt.Sprint(f.Data)
+			wallets[host] = append(wallets[host], node)
+		}
+	}
+	for _, nodes := range wallets {
+		sort.Strings(nodes)
+	}
+	return wallets
+}
+
+// GetConnectedPeers returns every legion peer we're connected to. With
+// withWallets the wallet addresses of nodes advertising the peer's host in the
+// state are added, which helps with troubleshooting but isn't verified in any
+// way.
+func (p *Peer) GetConnectedPeers(withWallets bool) []ConnectedPeer {
+	remotes := make([]utils.LegionAddress, 0)
+	hosts := make(map[string]string)
+	p.net.DoAllPeers(func(peer *network.Peer) {
+		remotes = append(remotes, peer.Remote())
+		hosts[peer.Remote().String()] = peer.Remote().Host
+	})
+	peers := p.topology.connected(remotes, p.net.PeerPromoted, time.Now())
+
+	if withWallets {
+		wallets := walletsByHost(p.GetState().Snapshot())
+		for i := range peers {
+			peers[i].WalletAddresses = wallets[hosts[peers[i].Address]]
+		}
+	}
+	return peers
+}
+
+// GetDiscoveredPeers returns the peer addresses other peers have told us
+// about, and whether we're connected to them
+func (p *Peer) GetDiscoveredPeers() []DiscoveredPeer {
+	return p.topology.discoveryTable(p.net.PeerExists)
+}
@@ -0,0 +1,64 @@
+package peer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/legion/utils"
+)
+
+func TestTopologyTracksPeers(t *testing.T) {
+	tp := newTopologyPlugin()
+	a := utils.NewLegionAddress("10.0.0.1", 7947)
+	b := utils.NewLegionAddress("10.0.0.2", 7947)
+	start := time.Unix(1000, 0)
+
+	tp.recordConnected(a, false, start)
+	tp.recordMessage(a, "peer_list", []byte(`["10.0.0.2:7947","10.0.0.3:7947","not an address"]`), start.Add(10*time.Second))
+	tp.recordMessage(b, "state_update", []byte("{}"), start.Add(20*time.Second))
+
+	peers := tp.connected([]utils.LegionAddress{b, a}, func(addr utils.LegionAddress) bool { return addr == a }, start.Add(30*time.Second))
+	if len(peers) != 2 || peers[0].Address != a.String() {
+		t.Fatalf("unexpected peers: %+v", peers)
+	}
+	if !peers[0].Promoted || peers[0].ConnectedFor != 30 || peers[0].LastMessage != start.Add(10*time.Second).Unix() {
+		t.Errorf("unexpected info for %s: %+v", a, peers[0])
+	}
+	if peers[1].Messages != 1 || peers[1].ConnectedAt != start.Add(20*time.Second).Unix() {
+		t.Errorf("unexpected info for %s: %+v", b, peers[1])
+	}
+
+	discovered := tp.discoveryTable(func(addr utils.LegionAddress) bool { return addr == b })
+	if len(discovered) != 2 || discovered[0].Address != b.String() || !discovered[0].Connected || discovered[1].Connected {
+		t.Errorf("unexpected discovery table: %+v", discovered)
+	}
+	if discovered[0].From != a.String() {
+		t.Errorf("expected %s to be discovered from %s, got %s", b, a, discovered[0].From)
+	}
+}
+
+func TestTopologyTablesAreBounded(t *testing.T) {
+	tp := newTopologyPlugin()
+	from := utils.NewLegionAddress("10.0.0.1", 7947)
+	start := time.Unix(1000, 0)
+
+	for i := 0; i <= maxTopologyEntries; i++ {
+		addr := fmt.Sprintf("10.1.%d.%d:7947", i/256, i%256)
+		tp.recordMessage(from, "new_peer", []byte(addr), start.Add(time.Duration(i)*time.Second))
+	}
+	if len(tp.discovered) != maxTopologyEntries {
+		t.Fatalf("expected %d discovered peers, got %d", maxTopologyEntries, len(tp.discovered))
+	}
+	if _, ok := tp.discovered[utils.NewLegionAddress("10.1.0.0", 7947)]; ok {
+		t.Error("oldest discovered peer wasn't replaced")
+	}
+}
+
+func TestWalletsByHost(t *testing.T) {
+	p := newContentPeer(t, 2, 1)
+	wallets := walletsByHost(p.GetState().Snapshot())
+	if len(wallets) != 2 || len(wallets["10.0.0.1"]) != 1 {
+		t.Errorf("unexpected wallets: %v", wallets)
+	}
+}
@@ -0,0 +1,145 @@
+package peer
+
+import (
+	"sync/atomic"
+
+	"github.com/gladiusio/legion/utils"
+	"github.com/spf13/viper"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+)
+
+// verifyJob is a received state message waiting to be verified and applied
+type verifyJob struct {
+	sm *signature.SignedMessage
+
+	// Direct updates are relayed on if they are new to us, sync replies aren't
+	relay  bool
+	hops   int
+	sender utils.LegionAddress
+}
+
+// VerifierStats counts what happened to received state messages
+type VerifierStats struct {
+	Workers        int    `json:"workers"`
+	QueuedUpdates  int    `json:"queued_updates"`
+	QueuedSync     int    `json:"queued_sync"`
+	Processed      uint64 `json:"processed"`
+	Accepted       uint64 `json:"accepted"`
+	DroppedUpdates uint64 `json:"dropped_updates"`
+	DroppedSync    uint64 `json:"dropped_sync"`
+}
+
+// verifier checks signatures and applies received state messages with a fixed
+// number of workers, so a flood of messages can't start an unbounded number of
+// goroutines or membership requests. Direct updates are handled before sync
+// replies. Both are dropped when their queue is full, legion hands every
+// message to the plugins in its own goroutine so waiting for room would only
+// pile up message bodies in memory. Dropped updates are sent again by another
+// peer or repaired by the next sync, and dropped sync replies by the sync
+// after that.
+type verifier struct {
+	processed      uint64 // First so they are aligned for atomic access
+	accepted       uint64
+	droppedUpdates uint64
+	droppedSync    uint64
+
+	workers int
+	updates chan *verifyJob
+	sync    chan *verifyJob
+	handle  func(*verifyJob) bool
+}
+
+// newVerifier starts the workers, handle returns true if the message was
+// accepted
+func newVerifier(workers, queueSize int, handle func(*verifyJob) bool) *verifier {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	v := &verifier{
+		workers: workers,
+		updates: make(chan *verifyJob, queueSize),
+		sync:    make(chan *verifyJob, queueSize),
+		handle:  handle,
+	}
+	for i := 0; i < workers; i++ {
+		go v.work()
+	}
+	return v
+}
+
+func newVerifierFromViper(handle func(*verifyJob) bool) *verifier {
+	return newVerifier(viper.GetInt("P2P.Verify.Workers"), viper.GetInt("P2P.Verify.QueueSize"), handle)
+}
+
+func (v *verifier) work() {
+	for {
+		// Always take a direct update if there is one waiting
+		select {
+		case job := <-v.updates:
+			v.run(job)
+			continue
+		default:
+		}
+
+		select {
+		case job := <-v.updates:
+			v.run(job)
+		case job := <-v.sync:
+			v.run(job)
+		}
+	}
+}
+
+func (v *verifier) run(job *verifyJob) {
+	if v.handle(job) {
+		atomic.AddUint64(&v.accepted, 1)
+	}
+	atomic.AddUint64(&v.processed, 1)
+}
+
+// SubmitUpdate queues a direct update, returns false if it was dropped because
+// the queue is full
+func (v *verifier) SubmitUpdate(job *verifyJob) bool {
+	select {
+	case v.updates <- job:
+		return true
+	default:
+		atomic.AddUint64(&v.droppedUpdates, 1)
+		return false
+	}
+}
+
+// SubmitSync queues a message from a sync reply, returns false if it was
+// dropped because the queue is full
+func (v *verifier) SubmitSync(job *verifyJob) bool {
+	select {
+	case v.sync <- job:
+		return true
+	default:
+		atomic.AddUint64(&v.droppedSync, 1)
+		return false
+	}
+}
+
+// Stats returns the queue lengths and message counts
+func (v *verifier) Stats() VerifierStats {
+	return VerifierStats{
+		Workers:        v.workers,
+		QueuedUpdates:  len(v.updates),
+		QueuedSync:     len(v.sync),
+		Processed:      atomic.LoadUint64(&v.processed),
+		Accepted:       atomic.LoadUint64(&v.accepted),
+		DroppedUpdates: atomic.LoadUint64(&v.droppedUpdates),
+		DroppedSync:    atomic.LoadUint64(&v.droppedSync),
+	}
+}
+
+// GetVerifierStats returns how many received state messages are waiting to be
+// verified and what happened to the ones that were
+func (p *Peer) GetVerifierStats() VerifierStats {
+	return p.statePlugin.verifier.Stats()
+}
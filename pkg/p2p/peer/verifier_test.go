@@ -0,0 +1,69 @@
+package peer
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerifierPrefersUpdatesAndDropsWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	var mux sync.Mutex
+	order := make([]string, 0)
+	handled := make(chan struct{}, 10)
+
+	v := newVerifier(1, 1, func(job *verifyJob) bool {
+		if job.sender.Host == "first" {
+			<-release
+		}
+		mux.Lock()
+		order = append(order, job.sender.Host)
+		mux.Unlock()
+		handled <- struct{}{}
+		return job.relay
+	})
+
+	first := &verifyJob{}
+	first.sender.Host = "first"
+	v.SubmitSync(first)
+	// Wait for the worker to pick up the first job
+	for len(v.sync) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	queued := &verifyJob{}
+	queued.sender.Host = "sync"
+	if !v.SubmitSync(queued) {
+		t.Fatal("sync message was dropped with room in the queue")
+	}
+	if v.SubmitSync(&verifyJob{}) {
+		t.Error("sync message wasn't dropped with a full queue")
+	}
+	update := &verifyJob{relay: true}
+	update.sender.Host = "update"
+	if !v.SubmitUpdate(update) {
+		t.Fatal("update was dropped with room in the queue")
+	}
+	if v.SubmitUpdate(&verifyJob{relay: true}) {
+		t.Error("update wasn't dropped with a full queue")
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-handled
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if order[1] != "update" || order[2] != "sync" {
+		t.Errorf("expected the update before the sync reply, got %v", order)
+	}
+	// The counts are updated after the handler returns
+	for v.Stats().Processed != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	stats := v.Stats()
+	if stats.Processed != 3 || stats.Accepted != 1 || stats.DroppedUpdates != 1 || stats.DroppedSync != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,281 @@
+package signature
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	response2 "github.com/gladiusio/gladius-common/pkg/routing/responses"
+	"github.com/gladiusio/gladius-common/pkg/utils"
+	"github.com/spf13/viper"
+)
+
+// MembershipProvider decides which signers are part of the pool and are
+// allowed to update the network state
+type MembershipProvider interface {
+	IsMember(address string) (bool, error)
+}
+
+// MembershipProviderFunc lets an ordinary function be used as a
+// MembershipProvider
+type MembershipProviderFunc func(address string) (bool, error)
+
+// IsMember calls f(address)
+func (f MembershipProviderFunc) IsMember(address string) (bool, error) {
+	return f(address)
+}
+
+var (
+	defaultMembership     MembershipProvider
+	defaultMembershipOnce sync.Once
+)
+
+// DefaultMembershipProvider returns a provider built from the config the first
+// time it is called. If the config can't be used every lookup will fail.
+func DefaultMembershipProvider() MembershipProvider {
+	defaultMembershipOnce.Do(func() {
+		mp, err := NewMembershipProviderFromConfig()
+		if err != nil {
+			mp = MembershipProviderFunc(func(string) (bool, error) { return false, err })
+		}
+		defaultMembership = mp
+	})
+	return defaultMembership
+}
+
+// NewMembershipProviderFromConfig creates the provider selected by
+// P2P.MembershipProvider, which is one of "pool", "allowlist" or "open"
+func NewMembershipProviderFromConfig() (MembershipProvider, error) {
+	// Kept for testing setups that predate the providers
+	if viper.GetBool("P2P.MessageVerifyOverride") {
+		return AllowAllProvider{}, nil
+	}
+
+	switch kind := strings.ToLower(viper.GetString("P2P.MembershipProvider")); kind {
+	case "", "pool":
+		return NewCachedProvider(NewPoolServerProvider(viper.GetString("Blockchain.PoolUrl"))), nil
+	case "allowlist":
+		return NewAllowlistProvider(viper.GetString("P2P.MembershipAllowlist"))
+	case "open":
+		return AllowAllProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown membership provider: %s", kind)
+	}
+}
+
+// AllowAllProvider considers every signer to be a member of the pool
+type AllowAllProvider struct{}
+
+// IsMember always returns true
+func (AllowAllProvider) IsMember(address string) (bool, error) {
+	return true, nil
+}
+
+// PoolServerProvider asks the pool's application server about membership
+type PoolServerProvider struct {
+	poolURL string
+}
+
+// NewPoolServerProvider returns a provider for the pool server api at poolURL
+func NewPoolServerProvider(poolURL string) *PoolServerProvider {
+	return &PoolServerProvider{poolURL: poolURL}
+}
+
+// IsMember asks the pool server if the address is part of the pool
+func (p *PoolServerProvider) IsMember(address string) (bool, error) {
+	response, err := utils.SendRequest(http.MethodGet, p.poolURL+"applications/pool/contains/"+address, nil)
+	if err != nil {
+		return false, err
+	}
+
+	var defaultResponse response2.DefaultResponse
+	err = json.Unmarshal([]byte(response), &defaultResponse)
+	if err != nil {
+		return false, err
+	}
+	if !defaultResponse.Success {
+		return false, errors.New("pool server could not check membership: " + defaultResponse.Error)
+	}
+
+	byteResponse, _ := json.Marshal(defaultResponse.Response)
+	var poolContainsWallet struct{ ContainsWallet bool }
+	err = json.Unmarshal(byteResponse, &poolContainsWallet)
+	if err != nil {
+		return false, err
+	}
+
+	return poolContainsWallet.ContainsWallet, nil
+}
+
+// MemoryProvider is a provider backed by an in memory set of addresses, it is
+// mostly useful for tests
+type MemoryProvider struct {
+	members map[string]bool
+	mux     sync.RWMutex
+}
+
+// NewMemoryProvider returns a provider containing the given addresses
+func NewMemoryProvider(addresses ...string) *MemoryProvider {
+	mp := &MemoryProvider{members: make(map[string]bool)}
+	mp.Add(addresses...)
+	return mp
+}
+
+// Add adds the addresses to the set of members
+func (mp *MemoryProvider) Add(addresses ...string) {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+	for _, address := range addresses {
+		mp.members[strings.ToLower(address)] = true
+	}
+}
+
+// Remove removes the addresses from the set of members
+func (mp *MemoryProvider) Remove(addresses ...string) {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+	for _, address := range addresses {
+		delete(mp.members, strings.ToLower(address))
+	}
+}
+
+// IsMember returns true if the address has been added
+func (mp *MemoryProvider) IsMember(address string) (bool, error) {
+	mp.mux.RLock()
+	defer mp.mux.RUnlock()
+	return mp.members[strings.ToLower(address)], nil
+}
+
+// NewAllowlistProvider reads a file with one address per line and returns a
+// provider containing them. Blank lines and lines starting with # are ignored.
+func NewAllowlistProvider(path string) (*MemoryProvider, error) {
+	if path == "" {
+		return nil, errors.New("allowlist membership provider needs P2P.MembershipAllowlist to be set")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mp := NewMemoryProvider()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		mp.Add(line)
+	}
+
+	return mp, scanner.Err()
+}
+
+// CachedProvider remembers the answers of another provider for a configurable
+// amount of time, and makes concurrent lookups of the same address share one
+// request. Failed lookups are not cached so they are retried on the next
+// message. The cache holds at most P2P.MembershipCacheSize addresses, when it
+// is full expired answers are swept out first and then random ones.
+type CachedProvider struct {
+	provider MembershipProvider
+	entries  map[string]membershipEntry
+	inflight map[string]*membershipLookup
+
+	mux sync.Mutex
+}
+
+type membershipEntry struct {
+	member  bool
+	expires time.Time
+}
+
+// membershipLookup is a request that is currently in progress, other callers
+// wait on it instead of starting their own
+type membershipLookup struct {
+	wg     sync.WaitGroup
+	member bool
+	err    error
+}
+
+// NewCachedProvider wraps the given provider with a cache
+func NewCachedProvider(provider MembershipProvider) *CachedProvider {
+	return &CachedProvider{
+		provider: provider,
+		entries:  make(map[string]membershipEntry),
+		inflight: make(map[string]*membershipLookup),
+	}
+}
+
+// IsMember returns the cached answer if there is one, otherwise it asks the
+// wrapped provider
+func (c *CachedProvider) IsMember(address string) (bool, error) {
+	c.mux.Lock()
+	if entry, ok := c.entries[address]; ok {
+		if time.Now().Before(entry.expires) {
+			c.mux.Unlock()
+			return entry.member, nil
+		}
+		delete(c.entries, address)
+	}
+
+	// Someone is already asking, wait for their answer
+	if l, ok := c.inflight[address]; ok {
+		c.mux.Unlock()
+		l.wg.Wait()
+		return l.member, l.err
+	}
+
+	l := &membershipLookup{}
+	l.wg.Add(1)
+	c.inflight[address] = l
+	c.mux.Unlock()
+
+	l.member, l.err = c.provider.IsMember(address)
+
+	c.mux.Lock()
+	delete(c.inflight, address)
+	if l.err == nil {
+		ttl := viper.GetDuration("P2P.MembershipCacheTTL")
+		if !l.member {
+			ttl = viper.GetDuration("P2P.MembershipNegativeCacheTTL")
+		}
+		if ttl > 0 {
+			c.makeRoom(time.Now())
+			c.entries[address] = membershipEntry{member: l.member, expires: time.Now().Add(ttl)}
+		}
+	}
+	c.mux.Unlock()
+	l.wg.Done()
+
+	return l.member, l.err
+}
+
+// makeRoom sweeps out expired entries if the cache is full, then forgets
+// random ones until it is back under 90% so this doesn't run on every lookup.
+// The lock must be held.
+func (c *CachedProvider) makeRoom(now time.Time) {
+	size := viper.GetInt("P2P.MembershipCacheSize")
+	if size <= 0 || len(c.entries) < size {
+		return
+	}
+
+	for address, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, address)
+		}
+	}
+	// Map iteration order is random
+	for address := range c.entries {
+		if len(c.entries) < size*9/10 {
+			break
+		}
+		delete(c.entries, address)
+	}
+}
@@ -0,0 +1,98 @@
+package signature
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestCachedProviderCoalescesLookups(t *testing.T) {
+	viper.Set("P2P.MembershipCacheTTL", time.Minute)
+	viper.Set("P2P.MembershipNegativeCacheTTL", time.Minute)
+
+	var calls int32
+	release := make(chan struct{})
+	c := NewCachedProvider(MembershipProviderFunc(func(address string) (bool, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return address == "member", nil
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			member, err := c.IsMember("member")
+			if !member || err != nil {
+				t.Errorf("expected member, got %t %v", member, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Negative answers are cached too
+	c.IsMember("stranger")
+	c.IsMember("stranger")
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected 2 lookups, got %d", n)
+	}
+}
+
+func TestCachedProviderDoesNotCacheErrors(t *testing.T) {
+	viper.Set("P2P.MembershipCacheTTL", time.Minute)
+	viper.Set("P2P.MembershipNegativeCacheTTL", time.Minute)
+
+	calls := 0
+	c := NewCachedProvider(MembershipProviderFunc(func(address string) (bool, error) {
+		calls++
+		if calls == 1 {
+			return false, errors.New("pool server down")
+		}
+		return true, nil
+	}))
+
+	if _, err := c.IsMember("member"); err == nil {
+		t.Error("expected the first lookup to fail")
+	}
+	if member, err := c.IsMember("member"); !member || err != nil {
+		t.Errorf("expected the retry to succeed, got %t %v", member, err)
+	}
+}
+
+func TestCachedProviderIsBounded(t *testing.T) {
+	viper.Set("P2P.MembershipCacheTTL", time.Minute)
+	viper.Set("P2P.MembershipNegativeCacheTTL", time.Minute)
+	viper.Set("P2P.MembershipCacheSize", 100)
+	defer viper.Set("P2P.MembershipCacheSize", 0)
+
+	c := NewCachedProvider(MembershipProviderFunc(func(address string) (bool, error) {
+		return false, nil
+	}))
+	for i := 0; i < 1000; i++ {
+		c.IsMember(fmt.Sprintf("0x%d", i))
+		if len(c.entries) > 100 {
+			t.Fatalf("cache grew to %d entries", len(c.entries))
+		}
+	}
+
+	// Expired entries are swept out before anything else
+	for i := 0; len(c.entries) < 100; i++ {
+		c.IsMember(fmt.Sprintf("0xfill%d", i))
+	}
+	for address := range c.entries {
+		c.entries[address] = membershipEntry{expires: time.Now().Add(-time.Second)}
+	}
+	c.IsMember("0xnew")
+	if len(c.entries) != 1 {
+		t.Errorf("expected only the new entry after a sweep, got %d", len(c.entries))
+	}
+}
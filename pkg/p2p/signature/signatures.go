@@ -5,12 +5,9 @@ import (
 	b64 "encoding/base64"
 	"encoding/json"
 	"errors"
-	"net/http"
 	"regexp"
 	"time"
 
-	response2 "github.com/gladiusio/gladius-common/pkg/routing/responses"
-	"github.com/gladiusio/gladius-common/pkg/utils"
 	"github.com/spf13/viper"
 
 	"github.com/buger/jsonparser"
@@ -59,6 +56,52 @@ func (sm SignedMessage) GetTimestamp() int64 {
 	return timestamp
 }
 
+// GetSequence gets the signer's sequence number from the message, messages
+// from before sequence numbers were added return 0
+func (sm SignedMessage) GetSequence() int64 {
+	jsonBytes, _ := sm.Message.MarshalJSON()
+	sequence, _ := jsonparser.GetInt(jsonBytes, "sequence")
+	return sequence
+}
+
+// Order returns what the message is ordered by when deciding which of two
+// messages is newer
+func (sm SignedMessage) Order() Order {
+	return Order{Timestamp: sm.GetTimestamp(), Sequence: sm.GetSequence(), Hash: sm.Hash}
+}
+
+// IsNewerThan returns true if the message should replace other, a nil other
+// is always older
+func (sm SignedMessage) IsNewerThan(other *SignedMessage) bool {
+	return other == nil || sm.Order().Compare(other.Order()) > 0
+}
+
+// Order is the position of a message in the history of the state. Messages
+// are ordered by timestamp, then by the signer's sequence number, and ties
+// are broken by hash so every peer picks the same message.
+type Order struct {
+	Timestamp int64
+	Sequence  int64
+	Hash      []byte
+}
+
+// Compare returns -1, 0 or 1 if o is before, the same as, or after other
+func (o Order) Compare(other Order) int {
+	switch {
+	case o.Timestamp != other.Timestamp:
+		if o.Timestamp < other.Timestamp {
+			return -1
+		}
+		return 1
+	case o.Sequence != other.Sequence:
+		if o.Sequence < other.Sequence {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(o.Hash, other.Hash)
+}
+
 func (sm SignedMessage) GetAgeInSeconds() int64 {
 	jsonBytes, _ := sm.Message.MarshalJSON()
 	timestamp, _ := jsonparser.GetInt(jsonBytes, "timestamp")
@@ -98,29 +141,25 @@ func (sm SignedMessage) IsPoolManagerAndVerified() bool {
 	return sm.IsVerified() && sm.Address == viper.GetString("blockchain.PoolManagerAddress")
 }
 
+// IsInPoolAndVerified checks the signature and asks the default membership
+// provider if the signer is part of the pool
 func (sm SignedMessage) IsInPoolAndVerified() bool {
-	// Check if address is part of pool
-	// config override
-	if viper.GetBool("P2P.MessageVerifyOverride") {
-		return sm.IsVerified() && true
-	}
+	return sm.IsMemberAndVerified(DefaultMembershipProvider())
+}
 
+// IsMemberAndVerified checks the signature and asks the given membership
+// provider if the signer is part of the pool
+func (sm SignedMessage) IsMemberAndVerified(mp MembershipProvider) bool {
 	if !sm.IsVerified() {
 		return false
 	}
-	nodeAddress := sm.Address
-
-	poolURL := viper.GetString("Blockchain.PoolUrl")
 
-	response, _ := utils.SendRequest(http.MethodGet, poolURL+"applications/pool/contains/"+nodeAddress, nil)
-	var defaultResponse response2.DefaultResponse
-	json.Unmarshal([]byte(response), &defaultResponse)
-
-	byteResponse, _ := json.Marshal(defaultResponse.Response)
-	var poolContainsWallet struct{ ContainsWallet bool }
-	json.Unmarshal(byteResponse, &poolContainsWallet)
+	member, err := mp.IsMember(sm.Address)
+	if err != nil {
+		return false
+	}
 
-	return poolContainsWallet.ContainsWallet
+	return member
 }
 
 func CreateSignedMessage(message *message.Message, ga *blockchain.GladiusAccountManager) (*SignedMessage, error) {
@@ -0,0 +1,101 @@
+package state
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+)
+
+var (
+	// ErrFutureMessage is returned for messages dated further ahead of our
+	// clock than the allowed skew, they would otherwise never be replaced
+	ErrFutureMessage = errors.New("message timestamp is too far in the future")
+
+	// ErrExpiredMessage is returned for messages older than the maximum
+	// message age, so captured messages can't be replayed forever
+	ErrExpiredMessage = errors.New("message is older than the maximum message age")
+)
+
+const (
+	// skewTolerance is how many seconds ahead of our clock a message can be
+	// before it counts as skewed in the metrics
+	skewTolerance = 5
+
+	// skewMinMessages is how many messages we need from a signer before
+	// calling its clock skewed
+	skewMinMessages = 5
+)
+
+// SkewStats records how far ahead of our clock a signer's messages are
+type SkewStats struct {
+	Address  string `json:"address"`
+	Messages int    `json:"messages"`  // Messages checked from the signer
+	Ahead    int    `json:"ahead"`     // Messages dated ahead of our clock
+	Rejected int    `json:"rejected"`  // Messages rejected for being too far ahead
+	MaxSkew  int64  `json:"max_skew"`  // Furthest ahead a message was, in seconds
+	LastSkew int64  `json:"last_skew"` // Skew of the latest message, negative for the past
+	Skewed   bool   `json:"skewed"`    // Most of the signer's messages are ahead of our clock
+}
+
+// SetClockBounds sets how far in the future a message can be dated and how
+// old it can be. Zero disables either check.
+func (s *State) SetClockBounds(maxSkew, maxAge time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.maxClockSkew = maxSkew
+	s.maxMessageAge = maxAge
+}
+
+// checkTimestamp records the message in the signer's skew stats and returns
+// an error if its timestamp is out of bounds
+func (s *State) checkTimestamp(sm *signature.SignedMessage) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.skew == nil {
+		s.skew = make(map[string]*SkewStats)
+	}
+	stats, ok := s.skew[sm.Address]
+	if !ok {
+		stats = &SkewStats{Address: sm.Address}
+		s.skew[sm.Address] = stats
+	}
+
+	skew := sm.GetTimestamp() - time.Now().Unix()
+	stats.Messages++
+	stats.LastSkew = skew
+	if skew > skewTolerance {
+		stats.Ahead++
+	}
+	if skew > stats.MaxSkew {
+		stats.MaxSkew = skew
+	}
+
+	if s.maxClockSkew > 0 && skew > int64(s.maxClockSkew.Seconds()) {
+		stats.Rejected++
+		return ErrFutureMessage
+	}
+	if s.maxMessageAge > 0 && -skew > int64(s.maxMessageAge.Seconds()) {
+		return ErrExpiredMessage
+	}
+	return nil
+}
+
+// GetClockSkew returns the skew stats of every signer we have had a message
+// from, sorted by address
+func (s *State) GetClockSkew() []SkewStats {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	toReturn := make([]SkewStats, 0, len(s.skew))
+	for _, stats := range s.skew {
+		st := *stats
+		st.Skewed = st.Messages >= skewMinMessages && st.Ahead*2 > st.Messages
+		toReturn = append(toReturn, st)
+	}
+
+	sort.Slice(toReturn, func(i, j int) bool { return toReturn[i].Address < toReturn[j].Address })
+	return toReturn
+}
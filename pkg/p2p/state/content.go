@@ -0,0 +1,108 @@
+package state
+
+// contentField is the node list field the content index is built from
+const contentField = "disk_content"
+
+// contentIndex maps a content name to the addresses of the nodes that have it.
+// The address lists are replaced instead of changed, so a snapshot can share
+// them with the state.
+type contentIndex map[string][]string
+
+// update moves the node from the content in the old field to the content in
+// the new one, either can be nil
+func (ci contentIndex) update(address string, old, new interface{}) {
+	had := contentSet(old)
+	has := contentSet(new)
+	for name := range had {
+		if !has[name] {
+			ci.remove(name, address)
+		}
+	}
+	for name := range has {
+		if !had[name] {
+			ci.add(name, address)
+		}
+	}
+}
+
+func (ci contentIndex) add(name, address string) {
+	nodes := make([]string, len(ci[name]), len(ci[name])+1)
+	copy(nodes, ci[name])
+	ci[name] = append(nodes, address)
+}
+
+func (ci contentIndex) remove(name, address string) {
+	nodes := make([]string, 0, len(ci[name]))
+	for _, node := range ci[name] {
+		if node != address {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		delete(ci, name)
+		return
+	}
+	ci[name] = nodes
+}
+
+// contentSet returns the items of a list field as a set
+func contentSet(field interface{}) map[string]bool {
+	list, ok := field.(*SignedList)
+	if !ok {
+		return nil
+	}
+	set := make(map[string]bool, len(list.Data))
+	for _, item := range list.Data {
+		set[item] = true
+	}
+	return set
+}
+
+// computeContentIndex builds the content index from scratch
+func (s *State) computeContentIndex() contentIndex {
+	ci := make(contentIndex)
+	for address, nd := range s.NodeDataMap {
+		ci.update(address, nil, nd[contentField])
+	}
+	return ci
+}
+
+// NodesWithContent returns the addresses of the nodes that have the content in
+// their disk_content list. The returned slice must not be changed.
+func (s *State) NodesWithContent(name string) []string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.content[name]
+}
+
+// SnapshotContent returns a snapshot of only the nodes that have any of the
+// content, which is much cheaper than a full snapshot of a large state
+func (s *State) SnapshotContent(names []string) *Snapshot {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	snap := &Snapshot{
+		PoolData:    PoolData{},
+		NodeDataMap: make(map[string]NodeData),
+		content:     make(contentIndex, len(names)),
+	}
+	for _, name := range names {
+		nodes, ok := s.content[name]
+		if !ok {
+			continue
+		}
+		snap.content[name] = nodes
+		for _, address := range nodes {
+			if _, copied := snap.NodeDataMap[address]; copied {
+				continue
+			}
+			nd := s.NodeDataMap[address]
+			ndCopy := make(NodeData, len(nd))
+			for key, field := range nd {
+				ndCopy[key] = field
+			}
+			snap.NodeDataMap[address] = ndCopy
+		}
+	}
+	return snap
+}
@@ -0,0 +1,196 @@
+package state
+
+import (
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+)
+
+// DigestEntry summarises the message that last set a field
+type DigestEntry struct {
+	Timestamp int64  `json:"t"`
+	Sequence  int64  `json:"s,omitempty"`
+	Hash      []byte `json:"h,omitempty"`
+	Ops       int    `json:"o,omitempty"` // List operations since the last full replacement
+}
+
+// Digest is a compact summary of the state, it records when each field was
+// last set or deleted without including the data or signatures. Peers exchange digests
+// so they only have to send each other the messages the other side is
+// missing.
+type Digest struct {
+	Pool  map[string]DigestEntry            `json:"pool"`
+	Nodes map[string]map[string]DigestEntry `json:"nodes"`
+}
+
+// olderThan returns true if the entry is older than the message
+func (e DigestEntry) olderThan(sm *signature.SignedMessage) bool {
+	return e.order().Compare(sm.Order()) < 0
+}
+
+// behind returns true if the entry is missing changes the field has, list
+// operations can arrive out of order so the newest message isn't enough
+func (e DigestEntry) behind(field interface{}) bool {
+	sm := signedMessageOf(field)
+	if sm == nil {
+		return false
+	}
+	return e.olderThan(sm) || (e.order().Compare(sm.Order()) == 0 && e.Ops < opsOf(field))
+}
+
+func (e DigestEntry) order() signature.Order {
+	return signature.Order{Timestamp: e.Timestamp, Sequence: e.Sequence, Hash: e.Hash}
+}
+
+func newDigestEntry(sm *signature.SignedMessage) DigestEntry {
+	o := sm.Order()
+	return DigestEntry{Timestamp: o.Timestamp, Sequence: o.Sequence, Hash: o.Hash}
+}
+
+func newFieldDigestEntry(field interface{}) DigestEntry {
+	e := newDigestEntry(signedMessageOf(field))
+	e.Ops = opsOf(field)
+	return e
+}
+
+// signedMessageOf returns the newest message that changed the field
+func signedMessageOf(field interface{}) *signature.SignedMessage {
+	switch typedField := field.(type) {
+	case *SignedList:
+		return typedField.latest()
+	case *SignedField:
+		return typedField.SignedMessage
+	}
+	return nil
+}
+
+// messagesOf returns every message needed to rebuild the field
+func messagesOf(field interface{}) []*signature.SignedMessage {
+	switch typedField := field.(type) {
+	case *SignedList:
+		return typedField.messages()
+	case *SignedField:
+		return []*signature.SignedMessage{typedField.SignedMessage}
+	}
+	return nil
+}
+
+// opsOf returns how many list operations the field has
+func opsOf(field interface{}) int {
+	if list, ok := field.(*SignedList); ok {
+		return len(list.Ops)
+	}
+	return 0
+}
+
+// GetDigest returns a digest of the current state
+func (s *State) GetDigest() *Digest {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	d := &Digest{
+		Pool:  make(map[string]DigestEntry),
+		Nodes: make(map[string]map[string]DigestEntry),
+	}
+
+	for key, field := range s.PoolData {
+		if signedMessageOf(field) != nil {
+			d.Pool[key] = newFieldDigestEntry(field)
+		}
+	}
+
+	for address, nd := range s.NodeDataMap {
+		fields := make(map[string]DigestEntry)
+		for key, field := range nd {
+			if signedMessageOf(field) != nil {
+				fields[key] = newFieldDigestEntry(field)
+			}
+		}
+		d.Nodes[address] = fields
+	}
+
+	for key, sm := range s.tombstones {
+		if key.Node == "" {
+			d.Pool[key.Field] = newDigestEntry(sm)
+			continue
+		}
+		if d.Nodes[key.Node] == nil {
+			d.Nodes[key.Node] = make(map[string]DigestEntry)
+		}
+		d.Nodes[key.Node][key.Field] = newDigestEntry(sm)
+	}
+
+	return d
+}
+
+// GetSignatureListNewerThan returns the signed messages needed to bring a
+// peer with the given digest up to date with our state
+func (s *State) GetSignatureListNewerThan(d *Digest) []*signature.SignedMessage {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	sigs := &sigList{sigs: make(map[string]*signature.SignedMessage)}
+
+	for key, field := range s.PoolData {
+		if entry, ok := d.Pool[key]; !ok || entry.behind(field) {
+			sigs.Add(messagesOf(field)...)
+		}
+	}
+
+	for address, nd := range s.NodeDataMap {
+		theirFields := d.Nodes[address]
+		for key, field := range nd {
+			if entry, ok := theirFields[key]; !ok || entry.behind(field) {
+				sigs.Add(messagesOf(field)...)
+			}
+		}
+	}
+
+	for key, sm := range s.tombstones {
+		entry, ok := d.Pool[key.Field]
+		if key.Node != "" {
+			entry, ok = d.Nodes[key.Node][key.Field]
+		}
+		if !ok || entry.olderThan(sm) {
+			sigs.Add(sm)
+		}
+	}
+
+	return sigs.GetList()
+}
+
+// IsBehind returns true if the digest has fields or deletes that are missing
+// or older in our state, meaning we should ask that peer for its messages
+func (s *State) IsBehind(d *Digest) bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	for key, entry := range d.Pool {
+		if s.isBehindEntry("", key, entry) {
+			return true
+		}
+	}
+
+	for address, theirFields := range d.Nodes {
+		for key, entry := range theirFields {
+			if s.isBehindEntry(address, key, entry) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isBehindEntry returns true if the entry has changes to the field that we
+// don't
+func (s *State) isBehindEntry(node, key string, entry DigestEntry) bool {
+	sm := s.latestMessage(node, key)
+	if sm == nil {
+		return true
+	}
+	switch sm.Order().Compare(entry.order()) {
+	case -1:
+		return true
+	case 0:
+		return entry.Ops > opsOf(s.fieldOf(node, key))
+	}
+	return false
+}
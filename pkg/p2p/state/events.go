@@ -0,0 +1,91 @@
+package state
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+)
+
+// FieldChange describes a single field that was changed in the state. When a
+// whole node is removed Field is empty and Deleted is set.
+type FieldChange struct {
+	Scope     string      `json:"scope"` // "node" or "pool"
+	Node      string      `json:"node,omitempty"`
+	Field     string      `json:"field"`
+	Value     interface{} `json:"value"`
+	Deleted   bool        `json:"deleted,omitempty"`
+	Timestamp int64       `json:"timestamp"`
+	Signer    string      `json:"signer"`
+}
+
+// Subscription receives every accepted field change on C until it is passed
+// to Unsubscribe. If the reader falls behind changes are dropped rather than
+// slowing down the state.
+type Subscription struct {
+	dropped uint64 // First so it is aligned for atomic access
+
+	C <-chan FieldChange
+	c chan FieldChange
+}
+
+// Dropped returns how many changes were skipped because C was full
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// subscribers keeps track of everyone listening for state changes, it has its
+// own lock so publishing doesn't depend on the state lock
+type subscribers struct {
+	subs map[*Subscription]bool
+	mux  sync.Mutex
+}
+
+// Subscribe returns a subscription that buffers up to buffer changes
+func (s *State) Subscribe(buffer int) *Subscription {
+	c := make(chan FieldChange, buffer)
+	sub := &Subscription{C: c, c: c}
+
+	s.subscribers.mux.Lock()
+	defer s.subscribers.mux.Unlock()
+	if s.subscribers.subs == nil {
+		s.subscribers.subs = make(map[*Subscription]bool)
+	}
+	s.subscribers.subs[sub] = true
+
+	return sub
+}
+
+// Unsubscribe stops sending changes to the subscription and closes its channel
+func (s *State) Unsubscribe(sub *Subscription) {
+	s.subscribers.mux.Lock()
+	defer s.subscribers.mux.Unlock()
+	if s.subscribers.subs[sub] {
+		delete(s.subscribers.subs, sub)
+		close(sub.c)
+	}
+}
+
+// publish sends the change to every subscriber without blocking
+func (s *State) publish(change FieldChange) {
+	s.subscribers.mux.Lock()
+	defer s.subscribers.mux.Unlock()
+	for sub := range s.subscribers.subs {
+		select {
+		case sub.c <- change:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+func (s *State) publishField(scope, node, field string, value interface{}, sm *signature.SignedMessage) {
+	s.publish(FieldChange{
+		Scope:     scope,
+		Node:      node,
+		Field:     field,
+		Value:     value,
+		Timestamp: sm.GetTimestamp(),
+		Signer:    sm.Address,
+	})
+}
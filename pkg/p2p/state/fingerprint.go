@@ -0,0 +1,105 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+)
+
+// fingerprint is a hash of every (node, field, message hash) in the state,
+// including deletes. Each entry is hashed on its own and the hashes are
+// XORed together, so it doesn't depend on the order messages arrived in and
+// can be kept up to date by toggling entries in and out as they change.
+type fingerprint [sha256.Size]byte
+
+// toggle adds the entry to the fingerprint, or removes it if it was already
+// added
+func (f *fingerprint) toggle(kind, node, field string, sm *signature.SignedMessage) {
+	if sm == nil {
+		return
+	}
+	h := sha256.Sum256([]byte(kind + "\x00" + node + "\x00" + field + "\x00" + string(sm.Hash)))
+	for i := range f {
+		f[i] ^= h[i]
+	}
+}
+
+func (f *fingerprint) toggleField(node, key string, field interface{}) {
+	for _, sm := range messagesOf(field) {
+		f.toggle("field", node, key, sm)
+	}
+}
+
+// replaceField toggles only the messages that differ between the old and new
+// versions of the field, lists keep most of theirs when an operation is added
+func (f *fingerprint) replaceField(node, key string, old, updated interface{}) {
+	oldMessages := messagesOf(old)
+	if len(oldMessages) == 0 {
+		f.toggleField(node, key, updated)
+		return
+	}
+
+	kept := make(map[string]bool, len(oldMessages))
+	for _, sm := range oldMessages {
+		kept[string(sm.Hash)] = true
+	}
+	for _, sm := range messagesOf(updated) {
+		if kept[string(sm.Hash)] {
+			delete(kept, string(sm.Hash))
+			continue
+		}
+		f.toggle("field", node, key, sm)
+	}
+	for _, sm := range oldMessages {
+		if kept[string(sm.Hash)] {
+			f.toggle("field", node, key, sm)
+		}
+	}
+}
+
+func (f *fingerprint) toggleTombstone(key tombstoneKey, sm *signature.SignedMessage) {
+	f.toggle("delete", key.Node, key.Field, sm)
+}
+
+// Fingerprint returns a hash of the state that is the same on every peer with
+// the same state, so peers can check they agree without comparing everything
+func (s *State) Fingerprint() string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return hex.EncodeToString(s.fingerprint[:])
+}
+
+// computeFingerprint builds the fingerprint from scratch
+func (s *State) computeFingerprint() fingerprint {
+	var f fingerprint
+	for key, field := range s.PoolData {
+		f.toggleField("", key, field)
+	}
+	for address, nd := range s.NodeDataMap {
+		for key, field := range nd {
+			f.toggleField(address, key, field)
+		}
+	}
+	for key, sm := range s.tombstones {
+		f.toggleTombstone(key, sm)
+	}
+	return f
+}
+
+// setTombstone records a delete, replacing any older delete of the same thing
+func (s *State) setTombstone(key tombstoneKey, sm *signature.SignedMessage) {
+	s.removeTombstone(key)
+	s.tombstones[key] = sm
+	s.fingerprint.toggleTombstone(key, sm)
+	s.live.add(sm)
+}
+
+// removeTombstone forgets a delete
+func (s *State) removeTombstone(key tombstoneKey) {
+	if old, ok := s.tombstones[key]; ok {
+		s.fingerprint.toggleTombstone(key, old)
+		s.live.remove(old)
+		delete(s.tombstones, key)
+	}
+}
@@ -0,0 +1,234 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+)
+
+// compactSlack is how many superseded messages we allow in the journal on top
+// of the live ones before it is rewritten
+const compactSlack = 256
+
+// liveMessages counts the fields and deletes in the state each message is
+// part of, so the number of messages a compacted journal would hold is known
+// without walking the state
+type liveMessages map[string]int
+
+func (lm liveMessages) add(sms ...*signature.SignedMessage) {
+	for _, sm := range sms {
+		if sm != nil {
+			lm[string(sm.Hash)]++
+		}
+	}
+}
+
+func (lm liveMessages) remove(sms ...*signature.SignedMessage) {
+	for _, sm := range sms {
+		if sm == nil {
+			continue
+		}
+		if lm[string(sm.Hash)]--; lm[string(sm.Hash)] <= 0 {
+			delete(lm, string(sm.Hash))
+		}
+	}
+}
+
+// computeLiveMessages counts the live messages from scratch
+func (s *State) computeLiveMessages() liveMessages {
+	lm := make(liveMessages)
+	for _, field := range s.PoolData {
+		lm.add(messagesOf(field)...)
+	}
+	for _, nd := range s.NodeDataMap {
+		for _, field := range nd {
+			lm.add(messagesOf(field)...)
+		}
+	}
+	for _, sm := range s.tombstones {
+		lm.add(sm)
+	}
+	return lm
+}
+
+// Journal is an append only file of the signed messages accepted into the
+// state. It is replayed on startup so a restarted node doesn't have to wait
+// for a sync to serve a useful state.
+type Journal struct {
+	path    string
+	file    *os.File
+	entries int
+
+	mux sync.Mutex
+}
+
+// OpenJournal opens (or creates) the journal at the given path
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{path: path}
+
+	messages, err := j.read()
+	if err != nil {
+		return nil, err
+	}
+	j.entries = len(messages)
+
+	j.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Messages returns all of the messages currently in the journal. Lines that
+// can't be parsed (like one cut off by a crash) are skipped.
+func (j *Journal) Messages() ([]*signature.SignedMessage, error) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	return j.read()
+}
+
+// Append writes the signed message to the end of the journal
+func (j *Journal) Append(sm *signature.SignedMessage) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	return j.append(sm)
+}
+
+// AppendAndCompact writes the signed message to the end of the journal, then
+// replaces the contents with the messages from snapshot if the journal has
+// grown past twice the live messages plus compactSlack. The snapshot is taken
+// with the journal locked, so nothing can be appended between taking it and
+// writing it.
+func (j *Journal) AppendAndCompact(sm *signature.SignedMessage, live int, snapshot func() []*signature.SignedMessage) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if err := j.append(sm); err != nil {
+		return err
+	}
+	if j.entries > 2*live+compactSlack {
+		return j.compact(snapshot())
+	}
+	return nil
+}
+
+func (j *Journal) append(sm *signature.SignedMessage) error {
+	b, err := json.Marshal(sm)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.file.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	j.entries++
+
+	return nil
+}
+
+// Len returns the number of messages in the journal
+func (j *Journal) Len() int {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	return j.entries
+}
+
+// Compact replaces the contents of the journal with the given messages, this
+// is used to drop messages that have been superseded in the state
+func (j *Journal) Compact(messages []*signature.SignedMessage) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	return j.compact(messages)
+}
+
+// CompactWith is Compact with the messages from snapshot, which is called with
+// the journal locked
+func (j *Journal) CompactWith(snapshot func() []*signature.SignedMessage) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	return j.compact(snapshot())
+}
+
+func (j *Journal) compact(messages []*signature.SignedMessage) error {
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, sm := range messages {
+		b, err := json.Marshal(sm)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(b)
+		w.WriteByte('\n')
+	}
+
+	if err = w.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	// Swap the compacted file in and reopen it for appending
+	j.file.Close()
+	err = os.Rename(tmpPath, j.path)
+	if err != nil {
+		return err
+	}
+	j.file, err = os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	j.entries = len(messages)
+
+	return nil
+}
+
+// Close closes the underlying journal file
+func (j *Journal) Close() error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	return j.file.Close()
+}
+
+func (j *Journal) read() ([]*signature.SignedMessage, error) {
+	messages := make([]*signature.SignedMessage, 0)
+
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return messages, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			sm := &signature.SignedMessage{}
+			if json.Unmarshal(line, sm) == nil && sm.Message != nil {
+				messages = append(messages, sm)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return messages, nil
+}
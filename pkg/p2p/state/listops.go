@@ -0,0 +1,191 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/buger/jsonparser"
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+)
+
+// DefaultMaxListOps is how many operations a list keeps when its schema
+// doesn't say
+const DefaultMaxListOps = 256
+
+// maxOps returns how many operations the list field can keep
+func (fs FieldSchema) maxOps() int {
+	if fs.MaxOps > 0 {
+		return fs.MaxOps
+	}
+	return DefaultMaxListOps
+}
+
+// SignedListOp is a signed change that adds or removes items from a list
+// field without replacing the whole list, sent as
+// {"node": {"disk_content": {"add": [...], "remove": [...]}}}
+type SignedListOp struct {
+	Add           []string                 `json:"add,omitempty"`
+	Remove        []string                 `json:"remove,omitempty"`
+	SignedMessage *signature.SignedMessage `json:"signed_message"`
+}
+
+// parseListOp reads the add and remove lists from an operation
+func parseListOp(value []byte, sm *signature.SignedMessage) *SignedListOp {
+	op := &SignedListOp{SignedMessage: sm}
+	op.Add = parseStringList(value, "add")
+	op.Remove = parseStringList(value, "remove")
+	return op
+}
+
+// parseStringList returns the strings in the array at the path
+func parseStringList(value []byte, keys ...string) []string {
+	list := make([]string, 0)
+	jsonparser.ArrayEach(value, func(v []byte, dataType jsonparser.ValueType, offset int, err error) {
+		list = append(list, string(v))
+	}, keys...)
+	return list
+}
+
+// apply returns the items with the operation applied, removes win over adds
+// of the same item in one operation
+func (op *SignedListOp) apply(items []string) []string {
+	set := make(map[string]bool, len(items)+len(op.Add))
+	result := make([]string, 0, len(items)+len(op.Add))
+	for _, item := range items {
+		if !set[item] {
+			set[item] = true
+			result = append(result, item)
+		}
+	}
+	for _, item := range op.Add {
+		if !set[item] {
+			set[item] = true
+			result = append(result, item)
+		}
+	}
+
+	if len(op.Remove) == 0 {
+		return result
+	}
+	removed := make(map[string]bool, len(op.Remove))
+	for _, item := range op.Remove {
+		removed[item] = true
+	}
+	kept := result[:0]
+	for _, item := range result {
+		if !removed[item] {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// latest returns the newest message that changed the list
+func (l *SignedList) latest() *signature.SignedMessage {
+	newest := l.SignedMessage
+	for _, op := range l.Ops {
+		if op.SignedMessage.IsNewerThan(newest) {
+			newest = op.SignedMessage
+		}
+	}
+	return newest
+}
+
+// hasOp returns true if the message has already been applied to the list
+func (l *SignedList) hasOp(sm *signature.SignedMessage) bool {
+	for _, op := range l.Ops {
+		if op.SignedMessage.Order().Compare(sm.Order()) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// messages returns every message needed to rebuild the list
+func (l *SignedList) messages() []*signature.SignedMessage {
+	sms := make([]*signature.SignedMessage, 0, len(l.Ops)+1)
+	if l.SignedMessage != nil {
+		sms = append(sms, l.SignedMessage)
+	}
+	for _, op := range l.Ops {
+		sms = append(sms, op.SignedMessage)
+	}
+	return sms
+}
+
+// withOp returns a copy of the list with the operation added. Operations are
+// applied in message order on top of the last full replacement, so every peer
+// ends up with the same list no matter what order they arrive in. Since only
+// one signer can change a list, this behaves like an observed-remove set.
+func (l *SignedList) withOp(op *SignedListOp, scope, key string) *SignedList {
+	ops := append(append([]*SignedListOp{}, l.Ops...), op)
+	if len(l.Ops) == 0 || op.SignedMessage.IsNewerThan(l.latest()) {
+		// The common case, the operation is the newest change
+		return &SignedList{Data: op.apply(l.Data), SignedMessage: l.SignedMessage, Ops: ops}
+	}
+
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].SignedMessage.Order().Compare(ops[j].SignedMessage.Order()) < 0
+	})
+	return newSignedList(l.baseItems(scope, key), l.SignedMessage, ops)
+}
+
+// baseItems returns the items set by the last full replacement. The base can
+// also be a delete, which has no items.
+func (l *SignedList) baseItems(scope, key string) []string {
+	if l.SignedMessage == nil {
+		return []string{}
+	}
+	jsonBytes, _ := l.SignedMessage.Message.MarshalJSON()
+	return parseStringList(jsonBytes, "content", scope, key)
+}
+
+// newSignedList builds a list from a full replacement and the operations after
+// it, ops must be in message order
+func newSignedList(items []string, base *signature.SignedMessage, ops []*SignedListOp) *SignedList {
+	for _, op := range ops {
+		items = op.apply(items)
+	}
+	return &SignedList{Data: items, SignedMessage: base, Ops: ops}
+}
+
+// planListOp checks an add or remove operation on a list field and adds it to
+// the plan
+func (s *State) planListOp(plan *updatePlan, node string, key string, schema FieldSchema, value []byte, sm *signature.SignedMessage) {
+	scope := scopeOf(node)
+	resultKey := scope + "." + key
+
+	current := s.fieldOf(node, key)
+	list, ok := current.(*SignedList)
+	if !ok {
+		// Start from the delete if the list was deleted, so operations from
+		// before it stay stale
+		list = &SignedList{Data: []string{}, SignedMessage: s.tombstones[tombstoneKey{Node: node, Field: key}]}
+	}
+	if !isNewer(sm, list.SignedMessage) || list.hasOp(sm) || s.isTombstoned(node, key, sm) {
+		plan.stale(resultKey)
+		return
+	}
+
+	op := parseListOp(value, sm)
+	updated := list.withOp(op, scope, key)
+	if len(updated.Ops) > schema.maxOps() {
+		// Keep the operations that come first, so every peer keeps the same
+		// ones no matter what order they arrived in
+		if updated.Ops[len(updated.Ops)-1] == op {
+			plan.reject(resultKey, FieldInvalid, fmt.Errorf("invalid value for %s: list has %d operations, the maximum is %d, it has to be replaced", key, len(list.Ops), schema.maxOps()))
+			return
+		}
+		updated = newSignedList(list.baseItems(scope, key), list.SignedMessage, updated.Ops[:schema.maxOps()])
+	}
+	if schema.MaxItems > 0 && len(updated.Data) > schema.MaxItems {
+		plan.reject(resultKey, FieldInvalid, fmt.Errorf("invalid value for %s: list would have %d items, the maximum is %d", key, len(updated.Data), schema.MaxItems))
+		return
+	}
+
+	plan.add(resultKey, func() {
+		s.setField(node, key, updated)
+		s.publishField(scope, node, key, updated.Data, sm)
+		s.removeTombstone(tombstoneKey{Node: node, Field: key})
+	})
+}
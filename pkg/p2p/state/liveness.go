@@ -0,0 +1,124 @@
+package state
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// NodeStatus describes how recently a node was heard from
+type NodeStatus struct {
+	Address  string `json:"address"`
+	LastSeen int64  `json:"last_seen"` // Timestamp of the newest message from the node
+	Age      int64  `json:"age"`       // Seconds since LastSeen
+	Alive    bool   `json:"alive"`
+}
+
+// SetNodeExpiry sets how long a node can go without a new message before it
+// is removed by ExpireNodes. Messages older than this are also rejected for
+// nodes that are missing or already stale, so expired nodes aren't synced back
+// in. Zero disables expiry.
+func (s *State) SetNodeExpiry(d time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.nodeExpiry = d
+}
+
+// lastSeen returns the timestamp of the newest message that set one of the
+// node's fields. Heartbeats are the most frequent message so they are what
+// normally keeps this current.
+func (s *State) lastSeen(address string) int64 {
+	return s.NodeDataMap[address].lastSeen()
+}
+
+func (nd NodeData) lastSeen() int64 {
+	var newest int64
+	for _, field := range nd {
+		if sm := signedMessageOf(field); sm != nil && sm.GetTimestamp() > newest {
+			newest = sm.GetTimestamp()
+		}
+	}
+	return newest
+}
+
+// IsNodeAlive returns true if the node has sent a message within staleAfter
+func (s *State) IsNodeAlive(address string, staleAfter time.Duration) bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return time.Now().Unix()-s.lastSeen(address) <= int64(staleAfter.Seconds())
+}
+
+// GetNodeStatuses returns the liveness of every node in the state, sorted by
+// address
+func (s *State) GetNodeStatuses(staleAfter time.Duration) []NodeStatus {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	now := time.Now().Unix()
+	statuses := make([]NodeStatus, 0, len(s.NodeDataMap))
+	for address := range s.NodeDataMap {
+		lastSeen := s.lastSeen(address)
+		statuses = append(statuses, NodeStatus{
+			Address:  address,
+			LastSeen: lastSeen,
+			Age:      now - lastSeen,
+			Alive:    now-lastSeen <= int64(staleAfter.Seconds()),
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Address < statuses[j].Address })
+	return statuses
+}
+
+// ExpireNodes removes every node that hasn't sent a message within the node
+// expiry and returns their addresses
+func (s *State) ExpireNodes() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	removed := make([]string, 0)
+	if s.nodeExpiry <= 0 {
+		return removed
+	}
+
+	oldest := time.Now().Add(-s.nodeExpiry).Unix()
+	for address := range s.NodeDataMap {
+		if s.lastSeen(address) < oldest {
+			s.removeNode(address)
+			removed = append(removed, address)
+		}
+	}
+	for address, timestamp := range s.signerSeen {
+		if timestamp < oldest {
+			delete(s.signerSeen, address)
+		}
+	}
+	return removed
+}
+
+// RemoveNode removes the node and all of its fields from the state
+func (s *State) RemoveNode(address string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.NodeDataMap[address]; !ok {
+		return errors.New("node is not in the state")
+	}
+	s.removeNode(address)
+	return nil
+}
+
+func (s *State) removeNode(address string) {
+	for key, field := range s.NodeDataMap[address] {
+		s.replaceMessages(address, key, field, nil)
+	}
+	s.content.update(address, s.NodeDataMap[address][contentField], nil)
+	delete(s.NodeDataMap, address)
+	s.publish(FieldChange{Scope: "node", Node: address, Deleted: true, Timestamp: time.Now().Unix()})
+}
+
+// isExpired returns true if a message with the timestamp would already have
+// been removed by ExpireNodes
+func (s *State) isExpired(timestamp int64) bool {
+	return s.nodeExpiry > 0 && timestamp < time.Now().Add(-s.nodeExpiry).Unix()
+}
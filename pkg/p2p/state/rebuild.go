@@ -0,0 +1,85 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/buger/jsonparser"
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+)
+
+// RebuildResult reports which messages were accepted when rebuilding the
+// state from a list of signed messages
+type RebuildResult struct {
+	Accepted int               `json:"accepted"`
+	Rejected []RejectedMessage `json:"rejected"`
+}
+
+// RejectedMessage is a message that wasn't applied and why
+type RejectedMessage struct {
+	Hash    []byte `json:"hash"`
+	Address string `json:"address"`
+	Reason  string `json:"reason"`
+}
+
+// ParseSignedMessages reads signed messages from either a signature list
+// (a bare list, or an object with the list under "signatures" or "response"
+// like the /state/signatures output) or a full state, optionally under
+// "state". Nothing is verified here.
+func ParseSignedMessages(b []byte) ([]*signature.SignedMessage, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, errors.New("body is empty")
+	}
+
+	if b[0] == '[' {
+		sms := make([]*signature.SignedMessage, 0)
+		err := json.Unmarshal(b, &sms)
+		return sms, err
+	}
+
+	for _, key := range []string{"signatures", "response"} {
+		if list, dataType, _, err := jsonparser.Get(b, key); err == nil && dataType == jsonparser.Array {
+			return ParseSignedMessages(list)
+		}
+	}
+
+	if s, dataType, _, err := jsonparser.Get(b, "state"); err == nil && dataType == jsonparser.Object {
+		b = s
+	}
+	parsed, err := ParseNetworkState(b)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.GetSignatureList(), nil
+}
+
+// Rebuild re-verifies every message and applies it through UpdateState, so
+// the result is the same as if they had arrived over the network. Messages
+// are applied oldest first so only the ones that really are superseded get
+// rejected as stale.
+func (s *State) Rebuild(sms []*signature.SignedMessage) *RebuildResult {
+	result := &RebuildResult{Rejected: make([]RejectedMessage, 0)}
+
+	valid := make([]*signature.SignedMessage, 0, len(sms))
+	for _, sm := range sms {
+		if sm == nil || sm.Message == nil {
+			result.Rejected = append(result.Rejected, RejectedMessage{Reason: "malformed state message"})
+			continue
+		}
+		valid = append(valid, sm)
+	}
+	sort.SliceStable(valid, func(i, j int) bool { return valid[i].Order().Compare(valid[j].Order()) < 0 })
+
+	for i, err := range s.applyAll(valid) {
+		if err != nil {
+			sm := valid[i]
+			result.Rejected = append(result.Rejected, RejectedMessage{Hash: sm.Hash, Address: sm.Address, Reason: err.Error()})
+			continue
+		}
+		result.Accepted++
+	}
+	return result
+}
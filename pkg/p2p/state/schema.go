@@ -0,0 +1,296 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+
+	"github.com/buger/jsonparser"
+)
+
+// FieldType is the kind of value a state field holds
+type FieldType string
+
+// The field types understood by the state
+const (
+	TypeString     FieldType = "string" // Any single value, stored as a string
+	TypeInt        FieldType = "int"
+	TypePort       FieldType = "port"
+	TypeHost       FieldType = "host" // An IP address or hostname
+	TypeEnum       FieldType = "enum"
+	TypeBool       FieldType = "bool"
+	TypeNumber     FieldType = "number"
+	TypeObject     FieldType = "object"
+	TypeArray      FieldType = "array" // A JSON array of any values, replaced as a whole
+	TypeJSON       FieldType = "json"  // Any JSON value
+	TypeStringList FieldType = "string_list"
+)
+
+var hostnameRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// FieldSchema describes which values are valid for a field
+type FieldSchema struct {
+	Type FieldType `json:"type"`
+
+	// MaxSize is the maximum length in bytes of a value (or of each item in a
+	// list), 0 means no limit
+	MaxSize int `json:"max_size,omitempty"`
+
+	// MaxItems is the maximum number of items in a list, 0 means no limit
+	MaxItems int `json:"max_items,omitempty"`
+
+	// MaxOps is the maximum number of add and remove operations kept on a
+	// list, after that it has to be replaced. 0 means DefaultMaxListOps.
+	MaxOps int `json:"max_ops,omitempty"`
+
+	// Min and Max bound int and number fields when they are not both 0
+	Min int64 `json:"min,omitempty"`
+	Max int64 `json:"max,omitempty"`
+
+	// Values are the accepted values of an enum
+	Values []string `json:"values,omitempty"`
+}
+
+// Schema is the set of fields the state accepts for nodes and the pool
+type Schema struct {
+	Node map[string]FieldSchema `json:"node"`
+	Pool map[string]FieldSchema `json:"pool"`
+}
+
+// IsValid returns true if the type is one the state understands
+func (t FieldType) IsValid() bool {
+	switch t {
+	case TypeString, TypeInt, TypePort, TypeHost, TypeEnum, TypeBool, TypeNumber,
+		TypeObject, TypeArray, TypeJSON, TypeStringList:
+		return true
+	}
+	return false
+}
+
+// IsList returns true if the field holds a list of values
+func (fs FieldSchema) IsList() bool {
+	return fs.Type == TypeStringList
+}
+
+// Validate checks the raw value from an update message against the schema
+func (fs FieldSchema) Validate(value []byte, dataType jsonparser.ValueType) error {
+	if fs.IsList() {
+		switch dataType {
+		case jsonparser.Array:
+			return fs.validateItems(value)
+		case jsonparser.Object:
+			// An add or remove operation
+			return jsonparser.ObjectEach(value, func(key []byte, v []byte, dt jsonparser.ValueType, offset int) error {
+				if k := string(key); k != "add" && k != "remove" {
+					return fmt.Errorf("unknown list operation %q", k)
+				}
+				if dt != jsonparser.Array {
+					return fmt.Errorf("expected a list to %s, got %s", key, dt)
+				}
+				return fs.validateItems(v)
+			})
+		}
+		return fmt.Errorf("expected a list, got %s", dataType)
+	}
+
+	if err := fs.checkSize(value); err != nil {
+		return err
+	}
+
+	switch fs.Type {
+	case TypeObject:
+		if dataType != jsonparser.Object {
+			return fmt.Errorf("expected an object, got %s", dataType)
+		}
+		return nil
+	case TypeArray:
+		if dataType != jsonparser.Array {
+			return fmt.Errorf("expected a list, got %s", dataType)
+		}
+		items := 0
+		jsonparser.ArrayEach(value, func(v []byte, dt jsonparser.ValueType, offset int, err error) { items++ })
+		if fs.MaxItems > 0 && items > fs.MaxItems {
+			return fmt.Errorf("list has %d items, the maximum is %d", items, fs.MaxItems)
+		}
+		return nil
+	case TypeJSON:
+		if dataType == jsonparser.Null {
+			return fmt.Errorf("expected a value, got %s", dataType)
+		}
+		return nil
+	}
+
+	if dataType == jsonparser.Array || dataType == jsonparser.Object {
+		return fmt.Errorf("expected a single value, got %s", dataType)
+	}
+
+	s := string(value)
+	switch fs.Type {
+	case TypeString:
+		if dataType == jsonparser.Null {
+			return fmt.Errorf("expected a value, got %s", dataType)
+		}
+	case TypeInt, TypePort:
+		// Numbers are accepted as JSON numbers or strings
+		if dataType != jsonparser.Number && dataType != jsonparser.String {
+			return fmt.Errorf("expected a number, got %s", dataType)
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", s)
+		}
+		min, max := fs.Min, fs.Max
+		if fs.Type == TypePort {
+			min, max = 1, 65535
+		}
+		if (min != 0 || max != 0) && (n < min || n > max) {
+			return fmt.Errorf("%d is outside of the range %d to %d", n, min, max)
+		}
+	case TypeNumber:
+		if dataType != jsonparser.Number && dataType != jsonparser.String {
+			return fmt.Errorf("expected a number, got %s", dataType)
+		}
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return fmt.Errorf("%q is not a number", s)
+		}
+		if (fs.Min != 0 || fs.Max != 0) && (n < float64(fs.Min) || n > float64(fs.Max)) {
+			return fmt.Errorf("%v is outside of the range %d to %d", n, fs.Min, fs.Max)
+		}
+	case TypeBool:
+		if dataType != jsonparser.Boolean {
+			return fmt.Errorf("expected true or false, got %s", dataType)
+		}
+	case TypeHost:
+		if dataType != jsonparser.String {
+			return fmt.Errorf("expected a host, got %s", dataType)
+		}
+		if net.ParseIP(s) == nil && !hostnameRegexp.MatchString(s) {
+			return fmt.Errorf("%q is not an IP address or hostname", s)
+		}
+	case TypeEnum:
+		for _, v := range fs.Values {
+			if v == s {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %v", s, fs.Values)
+	default:
+		return fmt.Errorf("unknown field type %q", fs.Type)
+	}
+
+	return nil
+}
+
+// Decode returns the value the state stores for a validated single value.
+// Numbers are stored as json.Number in their canonical form, so 8080, "8080"
+// and "08080" are the same value and always encode as valid JSON.
+func (fs FieldSchema) Decode(value []byte, dataType jsonparser.ValueType) (interface{}, error) {
+	switch fs.Type {
+	case TypeInt, TypePort:
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatInt(n, 10)), nil
+	case TypeNumber:
+		n, err := strconv.ParseFloat(string(value), 64)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return json.Number(strconv.FormatFloat(n, 'g', -1, 64)), nil
+	case TypeBool:
+		return jsonparser.ParseBoolean(value)
+	case TypeObject, TypeArray, TypeJSON:
+		if dataType == jsonparser.String {
+			return jsonparser.ParseString(value)
+		}
+		return decodeJSON(value)
+	}
+
+	if dataType == jsonparser.String {
+		return jsonparser.ParseString(value)
+	}
+	return string(value), nil
+}
+
+// decodeJSON decodes any JSON value, keeping numbers as json.Number
+func decodeJSON(value []byte) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(value))
+	d.UseNumber()
+	err := d.Decode(&v)
+	return v, err
+}
+
+// validateItems checks every item in a list value
+func (fs FieldSchema) validateItems(value []byte) error {
+	var itemErr error
+	items := 0
+	jsonparser.ArrayEach(value, func(v []byte, dt jsonparser.ValueType, offset int, err error) {
+		items++
+		if itemErr != nil {
+			return
+		}
+		if dt != jsonparser.String {
+			itemErr = fmt.Errorf("list item %d is a %s, not a string", items-1, dt)
+			return
+		}
+		itemErr = fs.checkSize(v)
+	})
+	if itemErr != nil {
+		return itemErr
+	}
+	if fs.MaxItems > 0 && items > fs.MaxItems {
+		return fmt.Errorf("list has %d items, the maximum is %d", items, fs.MaxItems)
+	}
+	return nil
+}
+
+func (fs FieldSchema) checkSize(value []byte) error {
+	if fs.MaxSize > 0 && len(value) > fs.MaxSize {
+		return fmt.Errorf("value is %d bytes, the maximum is %d", len(value), fs.MaxSize)
+	}
+	return nil
+}
+
+// RegisterNodeField registers a node field with a schema its values have to
+// match
+func (s *State) RegisterNodeField(field string, schema FieldSchema) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.nodeDataFields[field] = schema
+}
+
+// RegisterPoolField registers a pool field with a schema its values have to
+// match
+func (s *State) RegisterPoolField(field string, schema FieldSchema) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.poolDataFields[field] = schema
+}
+
+// GetSchema returns the schema of every registered field
+func (s *State) GetSchema() Schema {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	schema := Schema{
+		Node: make(map[string]FieldSchema),
+		Pool: make(map[string]FieldSchema),
+	}
+	for field, fs := range s.nodeDataFields {
+		schema.Node[field] = fs
+	}
+	for field, fs := range s.poolDataFields {
+		schema.Pool[field] = fs
+	}
+	return schema
+}
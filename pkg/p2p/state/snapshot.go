@@ -0,0 +1,73 @@
+package state
+
+import "time"
+
+// Snapshot is a copy of the state at one point in time that can be read
+// without any locking while updates keep being applied. The field values are
+// shared with the state, which is safe because a field is always replaced
+// with a new value rather than changed.
+type Snapshot struct {
+	PoolData    PoolData            `json:"pool_data"`
+	NodeDataMap map[string]NodeData `json:"node_data_map"`
+
+	content contentIndex
+}
+
+// Snapshot returns a consistent copy of the current pool and node data
+func (s *State) Snapshot() *Snapshot {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	snap := &Snapshot{
+		PoolData:    make(PoolData, len(s.PoolData)),
+		NodeDataMap: make(map[string]NodeData, len(s.NodeDataMap)),
+		content:     make(contentIndex, len(s.content)),
+	}
+	for key, field := range s.PoolData {
+		snap.PoolData[key] = field
+	}
+	for address, nd := range s.NodeDataMap {
+		ndCopy := make(NodeData, len(nd))
+		for key, field := range nd {
+			ndCopy[key] = field
+		}
+		snap.NodeDataMap[address] = ndCopy
+	}
+	for name, nodes := range s.content {
+		snap.content[name] = nodes
+	}
+	return snap
+}
+
+// GetPoolField gets the field by name from the pool
+func (snap *Snapshot) GetPoolField(key string) interface{} {
+	return snap.PoolData[key]
+}
+
+// GetNodeField gets the field by name from the node
+func (snap *Snapshot) GetNodeField(address, key string) interface{} {
+	return snap.NodeDataMap[address][key]
+}
+
+// GetNodeFieldsMap gets a map of node address to the field referenced by key
+func (snap *Snapshot) GetNodeFieldsMap(key string) map[string]interface{} {
+	toReturn := make(map[string]interface{})
+	for node, data := range snap.NodeDataMap {
+		if data[key] != nil {
+			toReturn[node] = data[key]
+		}
+	}
+	return toReturn
+}
+
+// NodesWithContent returns the addresses of the nodes that had the content in
+// their disk_content list. The returned slice must not be changed.
+func (snap *Snapshot) NodesWithContent(name string) []string {
+	return snap.content[name]
+}
+
+// IsNodeAlive returns true if the node had sent a message within staleAfter
+// when the snapshot was taken
+func (snap *Snapshot) IsNodeAlive(address string, staleAfter time.Duration) bool {
+	return time.Now().Unix()-snap.NodeDataMap[address].lastSeen() <= int64(staleAfter.Seconds())
+}
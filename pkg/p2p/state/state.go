@@ -1,33 +1,75 @@
 package state
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/buger/jsonparser"
 	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+	"github.com/rs/zerolog/log"
 )
 
 // State is a type that represents the network state
 type State struct {
 	// poolDataFields and nodeDataFields keep track of what fields are valid for
-	// the protocol, 0 is SignedField, 1 is SignedList
-	poolDataFields map[string]int
-	nodeDataFields map[string]int
+	// the protocol and what values they accept
+	poolDataFields map[string]FieldSchema
+	nodeDataFields map[string]FieldSchema
 
 	// Keeps track of the actual data
 	PoolData    PoolData            `json:"pool_data"`
 	NodeDataMap map[string]NodeData `json:"node_data_map"`
 
-	mux sync.Mutex
+	// Records every accepted message so the state can be restored on restart,
+	// along with the journal messages that couldn't be verified on load
+	journal           *Journal
+	journalUnverified []*signature.SignedMessage
+
+	// Decides who is allowed to update the state
+	membership signature.MembershipProvider
+
+	// Hash of everything in the state, kept up to date on every change
+	fingerprint fingerprint
+
+	// Messages the state is made of, counted for journal compaction
+	live liveMessages
+
+	// Which nodes have each piece of content
+	content contentIndex
+
+	// Listeners for accepted field changes
+	subscribers subscribers
+
+	// How long nodes are kept without sending a new message, and the newest
+	// verified message timestamp from each signer
+	nodeExpiry time.Duration
+	signerSeen map[string]int64
+
+	// Signed deletes, kept so older updates can't bring deleted fields back
+	tombstones         map[tombstoneKey]*signature.SignedMessage
+	tombstoneRetention time.Duration
+
+	// Bounds on message timestamps, and how skewed each signer's clock is
+	maxClockSkew  time.Duration
+	maxMessageAge time.Duration
+	skew          map[string]*SkewStats
+
+	mux sync.RWMutex
 }
 
 // New returns a pointer to a State object
 func New() *State {
 	s := &State{}
-	s.poolDataFields = make(map[string]int)
-	s.nodeDataFields = make(map[string]int)
+	s.poolDataFields = make(map[string]FieldSchema)
+	s.nodeDataFields = make(map[string]FieldSchema)
+	s.tombstones = make(map[tombstoneKey]*signature.SignedMessage)
+	s.content = make(contentIndex)
+	s.live = make(liveMessages)
+	s.signerSeen = make(map[string]int64)
 	return s
 }
 
@@ -38,7 +80,7 @@ func (s *State) RegisterPoolListFields(fields ...string) {
 	defer s.mux.Unlock()
 
 	for _, field := range fields {
-		s.poolDataFields[field] = 1
+		s.poolDataFields[field] = FieldSchema{Type: TypeStringList}
 	}
 }
 
@@ -49,7 +91,7 @@ func (s *State) RegisterPoolSingleFields(fields ...string) {
 	defer s.mux.Unlock()
 
 	for _, field := range fields {
-		s.poolDataFields[field] = 0
+		s.poolDataFields[field] = FieldSchema{Type: TypeString}
 	}
 }
 
@@ -60,7 +102,7 @@ func (s *State) RegisterNodeListFields(fields ...string) {
 	defer s.mux.Unlock()
 
 	for _, field := range fields {
-		s.nodeDataFields[field] = 1
+		s.nodeDataFields[field] = FieldSchema{Type: TypeStringList}
 	}
 }
 
@@ -71,28 +113,100 @@ func (s *State) RegisterNodeSingleFields(fields ...string) {
 	defer s.mux.Unlock()
 
 	for _, field := range fields {
-		s.nodeDataFields[field] = 0
+		s.nodeDataFields[field] = FieldSchema{Type: TypeString}
 	}
 }
 
-// GetJSON gets the JSON representation of the state including signatures
-func (s *State) GetJSON() ([]byte, error) {
+// SetMembershipProvider sets the provider used to check if the signer of an
+// update is part of the pool
+func (s *State) SetMembershipProvider(mp signature.MembershipProvider) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	return json.Marshal(s)
+	s.membership = mp
+}
+
+// MembershipProvider returns the provider used to check if the signer of an
+// update is part of the pool
+func (s *State) MembershipProvider() signature.MembershipProvider {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.membership == nil {
+		return signature.DefaultMembershipProvider()
+	}
+	return s.membership
+}
+
+// LoadJournal replays and re-verifies every message in the journal, then
+// records all future accepted messages to it. Returns the number of messages
+// that were restored.
+func (s *State) LoadJournal(j *Journal) (int, error) {
+	messages, err := j.Messages()
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	unverified := make([]*signature.SignedMessage, 0)
+	for i, err := range s.applyAll(messages) {
+		switch err {
+		case nil:
+			restored++
+		case ErrNotVerified:
+			unverified = append(unverified, messages[i])
+		}
+	}
+	if len(unverified) > 0 {
+		log.Warn().Int("messages", len(unverified)).Msg("Journal messages couldn't be verified, they are kept to retry on the next restart")
+	}
+
+	s.mux.Lock()
+	s.journal = j
+	s.journalUnverified = unverified
+	s.mux.Unlock()
+
+	// Drop anything that was superseded
+	return restored, j.CompactWith(s.journalSnapshot)
+}
+
+// journalSnapshot returns the messages a compacted journal keeps, the live
+// state plus the journal messages that couldn't be verified when it was
+// loaded. Verification can fail because the pool server is down, so those
+// aren't thrown away.
+func (s *State) journalSnapshot() []*signature.SignedMessage {
+	live := s.GetSignatureList()
+
+	s.mux.RLock()
+	unverified := s.journalUnverified
+	s.mux.RUnlock()
+	if len(unverified) == 0 {
+		return live
+	}
+
+	sigs := &sigList{sigs: make(map[string]*signature.SignedMessage)}
+	sigs.Add(live...)
+	sigs.Add(unverified...)
+	return sigs.GetList()
+}
+
+// GetJSON gets the JSON representation of the state including signatures
+func (s *State) GetJSON() ([]byte, error) {
+	return json.Marshal(s.Snapshot())
 }
 
 type sigList struct {
 	sigs map[string]*signature.SignedMessage
 }
 
-func (s *sigList) Add(sig *signature.SignedMessage) {
-	if sig != nil {
-		s.sigs[string(sig.Hash)] = sig
+func (s *sigList) Add(sigs ...*signature.SignedMessage) {
+	for _, sig := range sigs {
+		if sig != nil {
+			s.sigs[string(sig.Hash)] = sig
+		}
 	}
 }
 
-func (s *sigList) GetList() (values []*signature.SignedMessage) {
+func (s *sigList) GetList() []*signature.SignedMessage {
+	values := make([]*signature.SignedMessage, 0, len(s.sigs))
 	for _, v := range s.sigs {
 		values = append(values, v)
 	}
@@ -101,8 +215,8 @@ func (s *sigList) GetList() (values []*signature.SignedMessage) {
 
 // GetPoolField gets the field by name from the pool
 func (s *State) GetPoolField(key string) interface{} {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 
 	if s.PoolData != nil {
 		return s.PoolData[key]
@@ -112,8 +226,8 @@ func (s *State) GetPoolField(key string) interface{} {
 
 // GetNodeFields gets the same field from all nodes
 func (s *State) GetNodeFields(key string) []interface{} {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 
 	toReturn := make([]interface{}, 0)
 	for _, node := range s.NodeDataMap {
@@ -124,8 +238,8 @@ func (s *State) GetNodeFields(key string) []interface{} {
 
 // GetNodeFieldsMap gets a map of node address to the field referenced by key
 func (s *State) GetNodeFieldsMap(key string) map[string]interface{} {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 
 	toReturn := make(map[string]interface{})
 
@@ -139,198 +253,309 @@ func (s *State) GetNodeFieldsMap(key string) map[string]interface{} {
 }
 
 func (s *State) GetNodeField(address, key string) interface{} {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 	return s.NodeDataMap[address][key]
 }
 
 // GetSignatureList returns a list of all of the signed messages used to make
 // the current state
 func (s *State) GetSignatureList() []*signature.SignedMessage {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 	sigs := &sigList{sigs: make(map[string]*signature.SignedMessage)}
 
-	if s.PoolData != nil {
-		for _, field := range s.PoolData {
-			switch typedField := field.(type) {
-			case *SignedList:
-				sigs.Add(typedField.SignedMessage)
-			case *SignedField:
-				sigs.Add(typedField.SignedMessage)
-			}
-		}
+	for _, field := range s.PoolData {
+		sigs.Add(messagesOf(field)...)
 	}
 	// Get all of the node signatures
 	for _, nd := range s.NodeDataMap {
 		for _, field := range nd {
-			switch typedField := field.(type) {
-			case *SignedList:
-				sigs.Add(typedField.SignedMessage)
-			case *SignedField:
-				sigs.Add(typedField.SignedMessage)
-			}
+			sigs.Add(messagesOf(field)...)
 		}
 	}
+	// Deletes are part of the state too
+	for _, sm := range s.tombstones {
+		sigs.Add(sm)
+	}
 
 	return sigs.GetList()
 }
 
 // UpdateState updates the local state with the signed message information
 func (s *State) UpdateState(sm *signature.SignedMessage) error {
-	if sm.IsInPoolAndVerified() {
-		jsonBytes, err := sm.Message.MarshalJSON()
-		if err != nil {
-			return errors.New("malformed state message")
-		}
+	_, err := s.ApplyUpdate(sm)
+	return err
+}
 
-		messageBytes, _, _, err := jsonparser.Get(jsonBytes, "content")
-		if err != nil {
-			return errors.New("can't find content in request")
+// errNodeExpired is returned for node messages older than the node expiry
+// when nothing newer has been seen from the node
+var errNodeExpired = errors.New("Message is older than the node expiry")
+
+// applyAll applies the messages in order and returns the error for each one,
+// nil if it was applied. Messages rejected because the node looked expired are
+// tried again at the end, a newer message from the same signer later in the
+// list shows it is still alive.
+func (s *State) applyAll(sms []*signature.SignedMessage) []error {
+	errs := make([]error, len(sms))
+	for i, sm := range sms {
+		errs[i] = s.UpdateState(sm)
+	}
+	for i, sm := range sms {
+		if errs[i] == errNodeExpired {
+			errs[i] = s.UpdateState(sm)
 		}
+	}
+	return errs
+}
 
-		timestamp := sm.GetTimestamp()
-
-		handler := func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
-			var err error
-			suc := false
-			switch string(key) {
-			case "node":
-				s.mux.Lock()
-				suc, err = s.nodeHandler(value, timestamp, sm)
-				s.mux.Unlock()
-			case "pool":
-				s.mux.Lock()
-				suc, err = s.poolHandler(value, timestamp, sm)
-				s.mux.Unlock()
-			}
-			if !suc && err == nil {
-				return errors.New("Nothing was updated")
-			}
-			return err
+// ErrNotVerified is returned for messages with an invalid signature or from
+// outside of the pool
+var ErrNotVerified = errors.New("message is not verified")
+
+// ApplyUpdate checks every field in the signed message before changing
+// anything, so the message is applied as a whole or not at all. Fields that
+// are older than the ones we have are skipped instead of failing the message,
+// that way every peer ends up with the newest value of each field no matter
+// what order the messages arrive in. Returns the outcome of every field.
+func (s *State) ApplyUpdate(sm *signature.SignedMessage) (*UpdateResult, error) {
+	plan := newUpdatePlan()
+	if !sm.IsMemberAndVerified(s.MembershipProvider()) {
+		return plan.result, ErrNotVerified
+	}
+
+	jsonBytes, err := sm.Message.MarshalJSON()
+	if err != nil {
+		return plan.result, errors.New("malformed state message")
+	}
+
+	messageBytes, _, _, err := jsonparser.Get(jsonBytes, "content")
+	if err != nil {
+		return plan.result, errors.New("can't find content in request")
+	}
+
+	if err := s.checkTimestamp(sm); err != nil {
+		return plan.result, err
+	}
+
+	timestamp := sm.GetTimestamp()
+
+	s.mux.Lock()
+	if timestamp > s.signerSeen[sm.Address] {
+		s.signerSeen[sm.Address] = timestamp
+	}
+	handler := func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		switch string(key) {
+		case "node":
+			return s.nodeHandler(value, timestamp, sm, plan)
+		case "pool":
+			return s.poolHandler(value, sm, plan)
+		case "delete":
+			return s.deleteHandler(value, sm, plan)
 		}
-		return jsonparser.ObjectEach(messageBytes, handler)
+		return nil
 	}
-	return errors.New("message is not verified")
-}
+	err = jsonparser.ObjectEach(messageBytes, handler)
+	if err == nil {
+		err = plan.check()
+	}
+	if err != nil {
+		s.mux.Unlock()
+		plan.skipAll()
+		return plan.result, err
+	}
+	plan.apply()
+	s.mux.Unlock()
 
-func (s *State) isUnderstoodNodeField(key string) bool {
-	_, ok := s.nodeDataFields[key]
-	return ok
+	s.journalMessage(sm)
+	return plan.result, nil
 }
 
-func (s *State) fieldType(key string) int {
-	if _, ok := s.nodeDataFields[key]; ok {
-		return s.nodeDataFields[key]
+// journalMessage appends an accepted message to the journal (if there is one)
+// and compacts the journal when it has grown too far past the live state. A
+// journal failure doesn't undo the update, so it is only logged.
+func (s *State) journalMessage(sm *signature.SignedMessage) {
+	s.mux.RLock()
+	j := s.journal
+	live := len(s.live) + len(s.journalUnverified)
+	s.mux.RUnlock()
+
+	if j == nil {
+		return
 	}
-	return s.poolDataFields[key]
-}
 
-func (s *State) isUnderstoodPoolField(key string) bool {
-	_, ok := s.poolDataFields[key]
-	return ok
+	err := j.AppendAndCompact(sm, live, s.journalSnapshot)
+	if err != nil {
+		log.Error().Err(err).Msg("Error writing message to state journal")
+	}
 }
 
-func (s *State) nodeHandler(nodeUpdate []byte, timestamp int64, sm *signature.SignedMessage) (bool, error) {
-	if s.NodeDataMap == nil {
-		s.NodeDataMap = make(map[string]NodeData)
-	}
-	if s.NodeDataMap[sm.Address] == nil {
-		s.NodeDataMap[sm.Address] = NodeData{}
+func (s *State) nodeHandler(nodeUpdate []byte, timestamp int64, sm *signature.SignedMessage, plan *updatePlan) error {
+	// Don't let old messages bring back a node that has already expired. The
+	// newest message we've verified from the signer counts even if it didn't
+	// change anything, so the outcome doesn't depend on arrival order.
+	if s.isExpired(timestamp) && s.isExpired(s.lastSeen(sm.Address)) && s.isExpired(s.signerSeen[sm.Address]) {
+		return errNodeExpired
 	}
-	// Keep track of if we update the state or not
-	updated := false
+
 	handler := func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
 		keyString := string(key)
 		// If it's a different protocol, or not an understood field, don't add it to
 		// our state
-		if s.isUnderstoodNodeField(keyString) {
-			// Check if the our node has never been updated, or the incoming message
-			// is newer than the one we have
-			if s.fieldType(keyString) == 0 {
-				if s.NodeDataMap[sm.Address][keyString] == nil ||
-					s.NodeDataMap[sm.Address][keyString].(*SignedField).SignedMessage.GetTimestamp() < timestamp {
-
-					// Actually update the field
-					s.NodeDataMap[sm.Address][keyString] = &SignedField{Data: string(value), SignedMessage: sm}
-					updated = true
-					return nil
-				}
-			} else {
-				if s.NodeDataMap[sm.Address][keyString] == nil ||
-					s.NodeDataMap[sm.Address][keyString].(*SignedList).SignedMessage.GetTimestamp() < timestamp {
-
-					// Create a string list
-					contentList := make([]string, 0)
-					// Get all file names passed in
-					jsonparser.ArrayEach(value, func(v []byte, dataType jsonparser.ValueType, offset int, err error) {
-						contentList = append(contentList, string(v))
-					})
-
-					// Actually update the field
-					s.NodeDataMap[sm.Address][keyString] = &SignedList{Data: contentList, SignedMessage: sm}
-					updated = true
-					return nil
-				}
-			}
-			return errors.New("Message was older than the current version")
+		schema, ok := s.nodeDataFields[keyString]
+		if !ok {
+			plan.unknown("node." + keyString)
+			return nil
 		}
-		return errors.New("Unsupported field in update message")
+		s.planField(plan, sm.Address, keyString, schema, value, dataType, sm)
+		return nil
 	}
-	err := jsonparser.ObjectEach(nodeUpdate, handler)
-	return updated, err
+	return jsonparser.ObjectEach(nodeUpdate, handler)
 }
 
-func (s *State) poolHandler(poolUpdate []byte, timestamp int64, sm *signature.SignedMessage) (bool, error) {
-	if s.PoolData == nil {
-		s.PoolData = PoolData{}
-	}
-
+func (s *State) poolHandler(poolUpdate []byte, sm *signature.SignedMessage, plan *updatePlan) error {
 	// Don't update the state
 	if !sm.IsPoolManagerAndVerified() {
-		return false, errors.New("Message is not verified or not from pool manager")
+		return errors.New("Message is not verified or not from pool manager")
 	}
 
-	// Keep track of if we update the state or not
-	updated := false
 	handler := func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
 		keyString := string(key)
 		// If it's a different protocol, or not an understood field, don't add it to
 		// our state
-		if s.isUnderstoodPoolField(keyString) {
-			// Check if the our node has never been updated, or the incomming message
-			// is newer than the one we have
-			if s.fieldType(keyString) == 0 {
-				if s.PoolData[keyString] == nil ||
-					s.PoolData[keyString].(*SignedField).SignedMessage.GetTimestamp() < timestamp {
-
-					// Actually update the field
-					s.PoolData[keyString] = &SignedField{Data: string(value), SignedMessage: sm}
-					updated = true
-					return nil
-				}
-			} else {
-				if s.PoolData[keyString] == nil ||
-					s.PoolData[keyString].(*SignedList).SignedMessage.GetTimestamp() < timestamp {
-					// Create a string list
-					contentList := make([]string, 0)
-					// Get all file names passed in
-					jsonparser.ArrayEach(value, func(v []byte, dataType jsonparser.ValueType, offset int, err error) {
-						contentList = append(contentList, string(v))
-					})
-
-					// Actually update the field
-					s.PoolData[keyString] = &SignedList{Data: contentList, SignedMessage: sm}
-					updated = true
-					return nil
+		schema, ok := s.poolDataFields[keyString]
+		if !ok {
+			plan.unknown("pool." + keyString)
+			return nil
+		}
+		s.planField(plan, "", keyString, schema, value, dataType, sm)
+		return nil
+	}
+	return jsonparser.ObjectEach(poolUpdate, handler)
+}
+
+// planField checks a node field (or a pool field when node is empty) and adds
+// it to the plan if the message is newer than both the current value and any
+// delete of it
+func (s *State) planField(plan *updatePlan, node string, key string, schema FieldSchema, value []byte, dataType jsonparser.ValueType, sm *signature.SignedMessage) {
+	scope := scopeOf(node)
+	resultKey := scope + "." + key
+	if err := schema.Validate(value, dataType); err != nil {
+		plan.reject(resultKey, FieldInvalid, fmt.Errorf("invalid value for %s: %s", key, err))
+		return
+	}
+
+	if schema.IsList() && dataType == jsonparser.Object {
+		s.planListOp(plan, node, key, schema, value, sm)
+		return
+	}
+
+	current := s.fieldOf(node, key)
+	// Lists are compared to their last full replacement, add and remove
+	// operations newer than this message are kept
+	currentMessage := signedMessageOf(current)
+	list, isList := current.(*SignedList)
+	if isList {
+		currentMessage = list.SignedMessage
+	}
+	if !isNewer(sm, currentMessage) || s.isTombstoned(node, key, sm) {
+		plan.stale(resultKey)
+		return
+	}
+
+	var field, published interface{}
+	if !schema.IsList() {
+		data, err := schema.Decode(value, dataType)
+		if err != nil {
+			plan.reject(resultKey, FieldInvalid, fmt.Errorf("invalid value for %s: %s", key, err))
+			return
+		}
+		field = &SignedField{Data: data, SignedMessage: sm}
+		published = data
+	} else {
+		// Get all file names passed in
+		ops := make([]*SignedListOp, 0)
+		if isList {
+			for _, op := range list.Ops {
+				if op.SignedMessage.IsNewerThan(sm) {
+					ops = append(ops, op)
 				}
 			}
-			return errors.New("Message was older than the current version")
 		}
-		return errors.New("Unsupported field in update message")
+		updated := newSignedList(parseStringList(value), sm, ops)
+		field = updated
+		published = updated.Data
 	}
-	err := jsonparser.ObjectEach(poolUpdate, handler)
-	return updated, err
+
+	plan.add(resultKey, func() {
+		s.setField(node, key, field)
+		s.publishField(scope, node, key, published, sm)
+
+		// The field has been set again since it was deleted
+		s.removeTombstone(tombstoneKey{Node: node, Field: key})
+	})
+}
+
+// setField sets a node field, or a pool field when node is empty
+func (s *State) setField(node, key string, field interface{}) {
+	if node == "" {
+		if s.PoolData == nil {
+			s.PoolData = PoolData{}
+		}
+		s.replaceMessages(node, key, s.PoolData[key], field)
+		s.PoolData[key] = field
+	} else {
+		if s.NodeDataMap == nil {
+			s.NodeDataMap = make(map[string]NodeData)
+		}
+		if s.NodeDataMap[node] == nil {
+			s.NodeDataMap[node] = NodeData{}
+		}
+		s.replaceMessages(node, key, s.NodeDataMap[node][key], field)
+		if key == contentField {
+			s.content.update(node, s.NodeDataMap[node][key], field)
+		}
+		s.NodeDataMap[node][key] = field
+	}
+}
+
+// replaceMessages updates the fingerprint and live messages for a field
+// changing from old to updated, updated is nil when the field is removed
+func (s *State) replaceMessages(node, key string, old, updated interface{}) {
+	s.fingerprint.replaceField(node, key, old, updated)
+	s.live.remove(messagesOf(old)...)
+	s.live.add(messagesOf(updated)...)
+}
+
+// removeField removes a node field (or a pool field when node is empty), and
+// the node if it has no fields left
+func (s *State) removeField(node, key string) {
+	if node == "" {
+		s.replaceMessages(node, key, s.PoolData[key], nil)
+		delete(s.PoolData, key)
+		return
+	}
+
+	nd, ok := s.NodeDataMap[node]
+	if !ok {
+		return
+	}
+	s.replaceMessages(node, key, nd[key], nil)
+	if key == contentField {
+		s.content.update(node, nd[key], nil)
+	}
+	delete(nd, key)
+	if len(nd) == 0 {
+		delete(s.NodeDataMap, node)
+	}
+}
+
+// scopeOf returns the scope of a field on the node, pool fields have no node
+func scopeOf(node string) string {
+	if node == "" {
+		return "pool"
+	}
+	return "node"
 }
 
 // PoolData is a type that stores information about the pool
@@ -339,24 +564,82 @@ type PoolData map[string]interface{}
 // NodeData is a type that stores infomration about an indiviudal node
 type NodeData map[string]interface{}
 
-// SignedField is a type that represents a string field that includes the
-// signature that last updated it
+// SignedField is a type that represents a single typed value that includes
+// the signature that last updated it. Numbers are json.Number, objects and
+// arrays are the types encoding/json decodes them to.
 type SignedField struct {
 	Data          interface{}              `json:"data"`
 	SignedMessage *signature.SignedMessage `json:"signed_message"`
 }
 
+// UnmarshalJSON decodes the field keeping numbers as json.Number, the same as
+// they are stored when the update is applied
+func (f *SignedField) UnmarshalJSON(b []byte) error {
+	type field SignedField
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode((*field)(f))
+}
+
 // SignedList is a type that represents a list of string fields and includes the
-// signature that last updated it
+// signature that last replaced it, along with the add and remove operations
+// applied since then in message order. Ops is always in the JSON so lists can
+// be told apart from fields that hold an array.
 type SignedList struct {
 	Data          []string                 `json:"data"`
 	SignedMessage *signature.SignedMessage `json:"signed_message"`
+	Ops           []*SignedListOp          `json:"ops"`
+}
+
+// UnmarshalJSON decodes every field into a SignedField or SignedList
+func (nd *NodeData) UnmarshalJSON(b []byte) error {
+	fields, err := unmarshalFields(b)
+	*nd = NodeData(fields)
+	return err
+}
+
+// UnmarshalJSON decodes every field into a SignedField or SignedList
+func (pd *PoolData) UnmarshalJSON(b []byte) error {
+	fields, err := unmarshalFields(b)
+	*pd = PoolData(fields)
+	return err
+}
+
+func unmarshalFields(b []byte) (map[string]interface{}, error) {
+	raw := make(map[string]map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]interface{}, len(raw))
+	for key, rawField := range raw {
+		b, err := json.Marshal(rawField)
+		if err != nil {
+			return nil, err
+		}
+		if _, isList := rawField["ops"]; isList {
+			list := &SignedList{}
+			err = json.Unmarshal(b, list)
+			fields[key] = list
+		} else {
+			field := &SignedField{}
+			err = json.Unmarshal(b, field)
+			fields[key] = field
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decoding field %s: %s", key, err)
+		}
+	}
+	return fields, nil
 }
 
 // ParseNetworkState takes the network state json string in and returns a state
 // type if it is valid.
 func ParseNetworkState(stateString []byte) (*State, error) {
-	s := &State{}
+	s := New()
 	err := json.Unmarshal(stateString, s)
+	s.fingerprint = s.computeFingerprint()
+	s.content = s.computeContentIndex()
+	s.live = s.computeLiveMessages()
 	return s, err
 }
@@ -0,0 +1,870 @@
+package state
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/message"
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+)
+
+// signWithKey signs the message content the same way the account manager
+// would, without needing a keystore
+func signWithKey(t *testing.T, key *ecdsa.PrivateKey, m *message.Message) *signature.SignedMessage {
+	messageBytes := m.Serialize()
+	hash := crypto.Keccak256(messageBytes)
+	sig, err := crypto.Sign(hash, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := json.RawMessage(messageBytes)
+	return &signature.SignedMessage{
+		Message:   &h,
+		Hash:      hash,
+		Signature: sig,
+		Address:   crypto.PubkeyToAddress(key.PublicKey).String(),
+	}
+}
+
+func signedAt(t *testing.T, key *ecdsa.PrivateKey, content string, timestamp int64) *signature.SignedMessage {
+	m := message.New([]byte(content))
+	m.Timestamp = timestamp
+	return signWithKey(t, key, m)
+}
+
+// newTestState returns a state with the default fields where only the given
+// keys are pool members
+func newTestState(members ...*ecdsa.PrivateKey) *State {
+	mp := signature.NewMemoryProvider()
+	for _, key := range members {
+		mp.Add(crypto.PubkeyToAddress(key.PublicKey).String())
+	}
+
+	s := New()
+	s.SetMembershipProvider(mp)
+	s.RegisterNodeSingleFields("ip_address", "content_port", "heartbeat", "http_port")
+	s.RegisterNodeListFields("disk_content")
+	s.RegisterPoolListFields("required_content")
+	return s
+}
+
+func TestJournalRestoresState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.journal")
+
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestState(key)
+	if _, err := s.LoadJournal(j); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		sm := signedAt(t, key, `{"node":{"ip_address":"`+ip+`"}}`, int64(100+i))
+		if err := s.UpdateState(sm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if j.Len() != 3 {
+		t.Errorf("expected 3 journal entries, got %d", j.Len())
+	}
+	j.Close()
+
+	// Simulate a restart
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	restored := newTestState(key)
+	n, err := restored.LoadJournal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 messages to be replayed, got %d", n)
+	}
+
+	field := restored.GetNodeField(address, "ip_address")
+	if field == nil || field.(*SignedField).Data != `3.3.3.3` {
+		t.Errorf("restored state has the wrong ip_address: %v", field)
+	}
+
+	// Superseded messages should be compacted away on load
+	if j.Len() != 1 {
+		t.Errorf("expected the journal to be compacted to 1 entry, got %d", j.Len())
+	}
+}
+
+func TestJournalKeepsUnverifiedMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.journal")
+
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Append(signedAt(t, key, `{"node":{"ip_address":"1.1.1.1"}}`, 100))
+	j.Append(signedAt(t, key, `{"node":{"http_port":"8080"}}`, 101))
+
+	// Nobody is a member, like when the pool server can't be reached
+	s := newTestState()
+	n, err := s.LoadJournal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || j.Len() != 2 {
+		t.Fatalf("expected nothing restored and 2 journal entries, got %d and %d", n, j.Len())
+	}
+
+	// They are carried through compactions until they can be verified
+	other, _ := crypto.GenerateKey()
+	s.SetMembershipProvider(signature.NewMemoryProvider(crypto.PubkeyToAddress(other.PublicKey).String()))
+	for i := 0; i < 2*compactSlack; i++ {
+		s.UpdateState(signedAt(t, other, fmt.Sprintf(`{"node":{"heartbeat":%d}}`, i), int64(200+i)))
+	}
+	j.Close()
+
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	restored := newTestState(key, other)
+	restored.LoadJournal(j)
+	if restored.GetNodeField(address, "ip_address") == nil || restored.GetNodeField(address, "http_port") == nil {
+		t.Error("unverified journal messages were lost")
+	}
+}
+
+func TestJournalKeepsConcurrentUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.journal")
+
+	keys := make([]*ecdsa.PrivateKey, 8)
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+	}
+	messages := make([][]*signature.SignedMessage, len(keys))
+	for i, key := range keys {
+		for n := 0; n < 100; n++ {
+			messages[i] = append(messages[i], signedAt(t, key, fmt.Sprintf(`{"node":{"heartbeat":%d}}`, n), int64(100+n)))
+		}
+	}
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestState(keys...)
+	s.LoadJournal(j)
+
+	// Every update supersedes the last, so the journal is compacted while
+	// the other signers are still appending
+	var wg sync.WaitGroup
+	for _, sms := range messages {
+		wg.Add(1)
+		go func(sms []*signature.SignedMessage) {
+			defer wg.Done()
+			for _, sm := range sms {
+				s.UpdateState(sm)
+			}
+		}(sms)
+	}
+	wg.Wait()
+	j.Close()
+
+	if live := len(s.GetSignatureList()); len(s.live) != live {
+		t.Errorf("expected %d live messages, counted %d", live, len(s.live))
+	}
+
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	restored := newTestState(keys...)
+	restored.LoadJournal(j)
+	if restored.Fingerprint() != s.Fingerprint() {
+		t.Error("restored state is missing messages")
+	}
+}
+
+func TestUpdateStateRejectsNonMembers(t *testing.T) {
+	member, _ := crypto.GenerateKey()
+	stranger, _ := crypto.GenerateKey()
+	s := newTestState(member)
+
+	if err := s.UpdateState(signedAt(t, member, `{"node":{"ip_address":"1.1.1.1"}}`, 100)); err != nil {
+		t.Errorf("member update was rejected: %s", err)
+	}
+	if err := s.UpdateState(signedAt(t, stranger, `{"node":{"ip_address":"1.1.1.1"}}`, 100)); err == nil {
+		t.Error("update from a signer outside the pool was accepted")
+	}
+}
+
+func TestDigestOnlySendsNewerMessages(t *testing.T) {
+	a, _ := crypto.GenerateKey()
+	b, _ := crypto.GenerateKey()
+
+	ours := newTestState(a, b)
+	theirs := newTestState(a, b)
+
+	shared := signedAt(t, a, `{"node":{"ip_address":"1.1.1.1"}}`, 100)
+	ours.UpdateState(shared)
+	theirs.UpdateState(shared)
+
+	newer := signedAt(t, b, `{"node":{"ip_address":"2.2.2.2"}}`, 200)
+	ours.UpdateState(newer)
+
+	delta := ours.GetSignatureListNewerThan(theirs.GetDigest())
+	if len(delta) != 1 || string(delta[0].Hash) != string(newer.Hash) {
+		t.Fatalf("expected only the newer message in the delta, got %d messages", len(delta))
+	}
+	if !theirs.IsBehind(ours.GetDigest()) {
+		t.Error("expected their state to be behind ours")
+	}
+	if ours.IsBehind(theirs.GetDigest()) {
+		t.Error("expected our state to not be behind theirs")
+	}
+}
+
+func TestSubscribeReceivesFieldChanges(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	s := newTestState(key)
+	sub := s.Subscribe(10)
+	defer s.Unsubscribe(sub)
+
+	s.UpdateState(signedAt(t, key, `{"node":{"ip_address":"1.1.1.1","disk_content":["a/b"]}}`, 100))
+	// Stale, shouldn't produce an event
+	s.UpdateState(signedAt(t, key, `{"node":{"ip_address":"2.2.2.2"}}`, 50))
+
+	changes := make(map[string]FieldChange)
+	for len(sub.C) > 0 {
+		change := <-sub.C
+		changes[change.Field] = change
+	}
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %d", len(changes))
+	}
+	if c := changes["ip_address"]; c.Value != "1.1.1.1" || c.Timestamp != 100 || c.Node != c.Signer {
+		t.Errorf("unexpected change: %+v", c)
+	}
+}
+
+func TestUpdateStateRejectsInvalidValues(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	s := newTestState(key)
+	s.RegisterNodeField("http_port", FieldSchema{Type: TypePort})
+	s.RegisterNodeField("ip_address", FieldSchema{Type: TypeHost})
+
+	valid := []string{
+		`{"node":{"http_port":8080}}`,
+		`{"node":{"http_port":"8080"}}`,
+		`{"node":{"ip_address":"10.0.0.1"}}`,
+		`{"node":{"ip_address":"node.example.com"}}`,
+	}
+	for i, content := range valid {
+		if err := s.UpdateState(signedAt(t, key, content, int64(100+i))); err != nil {
+			t.Errorf("valid update %s was rejected: %s", content, err)
+		}
+	}
+
+	invalid := []string{
+		`{"node":{"http_port":"banana"}}`,
+		`{"node":{"http_port":70000}}`,
+		`{"node":{"ip_address":"not a host!"}}`,
+		`{"node":{"disk_content":"a/b"}}`,
+		`{"node":{"disk_content":[1,2]}}`,
+	}
+	for i, content := range invalid {
+		if err := s.UpdateState(signedAt(t, key, content, int64(200+i))); err == nil {
+			t.Errorf("invalid update %s was accepted", content)
+		}
+	}
+}
+
+func TestStaleNodesExpire(t *testing.T) {
+	fresh, _ := crypto.GenerateKey()
+	old, _ := crypto.GenerateKey()
+	s := newTestState(fresh, old)
+
+	now := time.Now().Unix()
+	s.UpdateState(signedAt(t, fresh, `{"node":{"heartbeat":1}}`, now))
+	s.UpdateState(signedAt(t, old, `{"node":{"heartbeat":1}}`, now-3600))
+
+	oldAddress := crypto.PubkeyToAddress(old.PublicKey).String()
+	if s.IsNodeAlive(oldAddress, 5*time.Minute) {
+		t.Error("node last seen an hour ago should be stale")
+	}
+	if !s.IsNodeAlive(crypto.PubkeyToAddress(fresh.PublicKey).String(), 5*time.Minute) {
+		t.Error("node seen just now should be alive")
+	}
+
+	s.SetNodeExpiry(30 * time.Minute)
+	removed := s.ExpireNodes()
+	if len(removed) != 1 || removed[0] != oldAddress {
+		t.Fatalf("expected only the old node to be removed, got %v", removed)
+	}
+
+	// Syncing the old message back in shouldn't resurrect the node
+	if err := s.UpdateState(signedAt(t, old, `{"node":{"http_port":"80"}}`, now-3500)); err == nil {
+		t.Error("message older than the expiry was accepted")
+	}
+}
+
+func TestNodeExpiryDoesNotDependOnOrder(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+	now := time.Now().Unix()
+
+	// A field set long ago on a node that is still sending heartbeats
+	old := signedAt(t, key, `{"node":{"ip_address":"1.1.1.1"}}`, now-10*24*3600)
+	heartbeat := signedAt(t, key, `{"node":{"heartbeat":1}}`, now)
+
+	rebuilt := newTestState(key)
+	rebuilt.SetNodeExpiry(7 * 24 * time.Hour)
+	if result := rebuilt.Rebuild([]*signature.SignedMessage{heartbeat, old}); result.Accepted != 2 {
+		t.Errorf("expected both messages to be rebuilt, got %+v", result)
+	}
+
+	live := newTestState(key)
+	live.SetNodeExpiry(7 * 24 * time.Hour)
+	live.UpdateState(heartbeat)
+	if err := live.UpdateState(old); err != nil {
+		t.Errorf("old field of a live node was rejected: %s", err)
+	}
+
+	for name, s := range map[string]*State{"rebuilt": rebuilt, "live": live} {
+		if s.GetNodeField(address, "ip_address") == nil {
+			t.Errorf("%s: old field is missing", name)
+		}
+	}
+}
+
+func TestDeleteWinsOverOlderUpdates(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+
+	set := signedAt(t, key, `{"node":{"ip_address":"1.1.1.1","http_port":"80"}}`, 100)
+	del := signedAt(t, key, `{"delete":{"node":["ip_address"]}}`, 200)
+
+	// Replay the delete before the update it removes, like a sync response can
+	s := newTestState(key)
+	if err := s.UpdateState(del); err != nil {
+		t.Fatalf("delete was rejected: %s", err)
+	}
+	if result, _ := s.ApplyUpdate(set); result.Fields["node.ip_address"] != FieldStale {
+		t.Errorf("update older than the delete was not stale: %v", result.Fields)
+	}
+	if s.GetNodeField(address, "ip_address") != nil {
+		t.Error("deleted field came back")
+	}
+
+	// A peer that missed the delete gets it from our digest
+	theirs := newTestState(key)
+	theirs.UpdateState(set)
+	if !theirs.IsBehind(s.GetDigest()) {
+		t.Error("peer without the delete should be behind")
+	}
+	for _, sm := range s.GetSignatureListNewerThan(theirs.GetDigest()) {
+		theirs.UpdateState(sm)
+	}
+	if theirs.GetNodeField(address, "ip_address") != nil {
+		t.Error("delete was not synced")
+	}
+
+	// Newer updates are accepted again, and a whole node delete removes them
+	if err := s.UpdateState(signedAt(t, key, `{"node":{"ip_address":"2.2.2.2"}}`, 300)); err != nil {
+		t.Errorf("update newer than the delete was rejected: %s", err)
+	}
+	if err := s.UpdateState(signedAt(t, key, `{"delete":{"node":["*"]}}`, 400)); err != nil {
+		t.Fatalf("node delete was rejected: %s", err)
+	}
+	if statuses := s.GetNodeStatuses(time.Minute); len(statuses) != 0 {
+		t.Errorf("node is still in the state: %v", statuses)
+	}
+
+	s.SetTombstoneRetention(time.Hour)
+	if n := s.ExpireTombstones(); n != 1 {
+		t.Errorf("expected 1 tombstone to expire, got %d", n)
+	}
+}
+
+func TestSameSecondUpdatesAreOrdered(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+	s := newTestState(key)
+
+	// Both signed in the same second, the later sequence number wins
+	first := signedAt(t, key, `{"node":{"ip_address":"1.1.1.1"}}`, 100)
+	second := signedAt(t, key, `{"node":{"ip_address":"2.2.2.2"}}`, 100)
+	if err := s.UpdateState(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateState(second); err != nil {
+		t.Errorf("second update in the same second was rejected: %s", err)
+	}
+	if err := s.UpdateState(first); err == nil {
+		t.Error("earlier sequence number replaced a later one")
+	}
+
+	// With equal timestamps and sequences every peer picks the same message
+	// no matter the order they arrive in
+	tied := make([]*signature.SignedMessage, 2)
+	for i, content := range []string{`{"node":{"ip_address":"3.3.3.3"}}`, `{"node":{"ip_address":"4.4.4.4"}}`} {
+		m := message.New([]byte(content))
+		m.Timestamp = 200
+		m.Sequence = 1
+		tied[i] = signWithKey(t, key, m)
+	}
+	a := newTestState(key)
+	a.UpdateState(tied[0])
+	a.UpdateState(tied[1])
+	b := newTestState(key)
+	b.UpdateState(tied[1])
+	b.UpdateState(tied[0])
+	if a.GetNodeField(address, "ip_address").(*SignedField).Data != b.GetNodeField(address, "ip_address").(*SignedField).Data {
+		t.Error("peers did not converge on the same value")
+	}
+}
+
+func TestUpdateStateRejectsSkewedMessages(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	s := newTestState(key)
+	s.SetClockBounds(time.Minute, time.Hour)
+
+	now := time.Now().Unix()
+	if err := s.UpdateState(signedAt(t, key, `{"node":{"heartbeat":1}}`, now+3600)); err != ErrFutureMessage {
+		t.Errorf("expected a future message error, got %v", err)
+	}
+	if err := s.UpdateState(signedAt(t, key, `{"node":{"heartbeat":1}}`, now-7200)); err != ErrExpiredMessage {
+		t.Errorf("expected an expired message error, got %v", err)
+	}
+	if err := s.UpdateState(signedAt(t, key, `{"node":{"heartbeat":1}}`, now+30)); err != nil {
+		t.Errorf("message within the allowed skew was rejected: %s", err)
+	}
+
+	for i := int64(0); i < skewMinMessages; i++ {
+		s.UpdateState(signedAt(t, key, `{"node":{"heartbeat":1}}`, now+40+i))
+	}
+	stats := s.GetClockSkew()
+	if len(stats) != 1 || !stats[0].Skewed || stats[0].Rejected != 1 {
+		t.Errorf("signer should be reported as skewed: %+v", stats)
+	}
+}
+
+func TestUpdatesAreAppliedAsAWhole(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+	s := newTestState(key)
+
+	result, err := s.ApplyUpdate(signedAt(t, key, `{"node":{"ip_address":"1.1.1.1","disk_content":5,"heartbeat":1}}`, 100))
+	if err == nil {
+		t.Fatal("message with an invalid field was accepted")
+	}
+	if result.Applied || result.Fields["node.disk_content"] != FieldInvalid ||
+		result.Fields["node.ip_address"] != FieldSkipped || result.Fields["node.heartbeat"] != FieldSkipped {
+		t.Errorf("unexpected outcomes: %+v", result)
+	}
+	if s.GetNodeField(address, "ip_address") != nil {
+		t.Error("field before the invalid one was applied")
+	}
+
+	// Fields we don't know about are skipped without failing the rest
+	result, err = s.ApplyUpdate(signedAt(t, key, `{"node":{"ip_address":"1.1.1.1","region":"eu","http_port":"80"},"delete":{"node":["zone"]}}`, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Applied || result.Fields["node.region"] != FieldUnknown || result.Fields["delete.node.zone"] != FieldUnknown ||
+		result.Fields["node.ip_address"] != FieldApplied || result.Fields["node.http_port"] != FieldApplied {
+		t.Errorf("unexpected outcomes: %+v", result)
+	}
+	if _, err := s.ApplyUpdate(signedAt(t, key, `{"node":{"region":"eu"}}`, 110)); err == nil {
+		t.Error("message with only unknown fields was accepted")
+	}
+
+	s.UpdateState(signedAt(t, key, `{"node":{"http_port":"8080"}}`, 200))
+	result, err = s.ApplyUpdate(signedAt(t, key, `{"node":{"ip_address":"1.1.1.1","http_port":"80"}}`, 150))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Fields["node.ip_address"] != FieldApplied || result.Fields["node.http_port"] != FieldStale {
+		t.Errorf("unexpected outcomes: %+v", result)
+	}
+	if s.GetNodeField(address, "http_port").(*SignedField).Data != "8080" {
+		t.Error("stale field replaced a newer one")
+	}
+}
+
+func TestListOperations(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+
+	messages := []*signature.SignedMessage{
+		signedAt(t, key, `{"node":{"disk_content":["a/1","a/2"]}}`, 100),
+		signedAt(t, key, `{"node":{"disk_content":{"add":["a/3"]}}}`, 200),
+		signedAt(t, key, `{"node":{"disk_content":{"remove":["a/1"]}}}`, 300),
+		signedAt(t, key, `{"node":{"disk_content":{"add":["a/1"],"remove":["a/2"]}}}`, 400),
+	}
+	want := []string{"a/3", "a/1"}
+
+	inOrder := newTestState(key)
+	for _, sm := range messages {
+		if err := inOrder.UpdateState(sm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Operations arriving out of order, before the list they change
+	reversed := newTestState(key)
+	for i := len(messages) - 1; i >= 0; i-- {
+		reversed.UpdateState(messages[i])
+	}
+	// A peer rebuilding from the signature list
+	synced := newTestState(key)
+	for _, sm := range inOrder.GetSignatureList() {
+		synced.UpdateState(sm)
+	}
+
+	for name, s := range map[string]*State{"in order": inOrder, "reversed": reversed, "synced": synced} {
+		list := s.GetNodeField(address, "disk_content").(*SignedList)
+		if fmt.Sprint(list.Data) != fmt.Sprint(want) {
+			t.Errorf("%s: expected %v, got %v", name, want, list.Data)
+		}
+	}
+
+	// A full replacement drops the older operations
+	inOrder.UpdateState(signedAt(t, key, `{"node":{"disk_content":["b/1"]}}`, 500))
+	if list := inOrder.GetNodeField(address, "disk_content").(*SignedList); len(list.Ops) != 0 || len(list.Data) != 1 {
+		t.Errorf("replacement didn't reset the list: %+v", list)
+	}
+	if err := inOrder.UpdateState(messages[3]); err == nil {
+		t.Error("operation older than the replacement was accepted")
+	}
+}
+
+func TestListOperationsAreCapped(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+
+	messages := []*signature.SignedMessage{
+		signedAt(t, key, `{"node":{"disk_content":["a/1"]}}`, 100),
+		signedAt(t, key, `{"node":{"disk_content":{"add":["a/3"]}}}`, 300),
+		signedAt(t, key, `{"node":{"disk_content":{"add":["a/4"]}}}`, 400),
+		signedAt(t, key, `{"node":{"disk_content":{"add":["a/5"]}}}`, 500),
+		signedAt(t, key, `{"node":{"disk_content":{"add":["a/2"]}}}`, 200),
+	}
+	newCappedState := func() *State {
+		s := newTestState(key)
+		s.RegisterNodeField("disk_content", FieldSchema{Type: TypeStringList, MaxOps: 2})
+		return s
+	}
+
+	inOrder := newCappedState()
+	for i, sm := range messages[:3] {
+		if err := inOrder.UpdateState(sm); err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+	}
+	if err := inOrder.UpdateState(messages[3]); err == nil {
+		t.Error("operation over the limit was accepted")
+	}
+	// An older operation takes the place of the newest one
+	if err := inOrder.UpdateState(messages[4]); err != nil {
+		t.Fatal(err)
+	}
+
+	reversed := newCappedState()
+	for i := len(messages) - 1; i >= 0; i-- {
+		reversed.UpdateState(messages[i])
+	}
+
+	want := []string{"a/1", "a/2", "a/3"}
+	for name, s := range map[string]*State{"in order": inOrder, "reversed": reversed} {
+		list := s.GetNodeField(address, "disk_content").(*SignedList)
+		if fmt.Sprint(list.Data) != fmt.Sprint(want) || len(list.Ops) != 2 {
+			t.Errorf("%s: expected %v with 2 operations, got %v with %d", name, want, list.Data, len(list.Ops))
+		}
+		if fp := s.computeFingerprint(); fp != s.fingerprint {
+			t.Errorf("%s: fingerprint wasn't kept up to date", name)
+		}
+	}
+	if inOrder.Fingerprint() != reversed.Fingerprint() {
+		t.Error("fingerprints differ")
+	}
+}
+
+func TestTypedValuesRoundTrip(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+	s := newTestState(key)
+	s.RegisterNodeField("http_port", FieldSchema{Type: TypePort})
+	s.RegisterNodeField("online", FieldSchema{Type: TypeBool})
+	s.RegisterNodeField("capacity", FieldSchema{Type: TypeObject})
+	s.RegisterNodeField("endpoints", FieldSchema{Type: TypeArray})
+
+	err := s.UpdateState(signedAt(t, key, `{"node":{"http_port":"8080","online":true,"capacity":{"disk":500,"bandwidth":1.5},"endpoints":[{"host":"a.example.com","port":443}],"disk_content":["a/b"]}}`, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := s.GetNodeField(address, "http_port").(*SignedField).Data; port != json.Number("8080") {
+		t.Errorf("port should be stored as a number, got %#v", port)
+	}
+
+	b, err := s.GetJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseNetworkState(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"http_port", "online", "capacity", "endpoints"} {
+		want := fmt.Sprint(s.GetNodeField(address, field).(*SignedField).Data)
+		got, ok := parsed.GetNodeField(address, field).(*SignedField)
+		if !ok || fmt.Sprint(got.Data) != want {
+			t.Errorf("%s didn't round trip, expected %s, got %#v", field, want, parsed.GetNodeField(address, field))
+		}
+	}
+	if _, ok := parsed.GetNodeField(address, "disk_content").(*SignedList); !ok {
+		t.Error("list field didn't round trip as a list")
+	}
+}
+
+func TestNumbersAreStoredCanonically(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+	s := newTestState(key)
+	s.RegisterNodeField("http_port", FieldSchema{Type: TypePort})
+	s.RegisterNodeField("load", FieldSchema{Type: TypeNumber})
+
+	ts := int64(100)
+	for value, want := range map[string]json.Number{`"08080"`: "8080", `"+8081"`: "8081", `"1.50"`: "1.5"} {
+		ts++
+		field := "http_port"
+		if want == "1.5" {
+			field = "load"
+		}
+		if err := s.UpdateState(signedAt(t, key, fmt.Sprintf(`{"node":{%q:%s}}`, field, value), ts)); err != nil {
+			t.Fatalf("%s: %s", value, err)
+		}
+		if got := s.GetNodeField(address, field).(*SignedField).Data; got != want {
+			t.Errorf("%s should be stored as %s, got %v", value, want, got)
+		}
+	}
+
+	for _, value := range []string{`"NaN"`, `"Inf"`, `"-Infinity"`, `"0x10"`} {
+		ts++
+		if err := s.UpdateState(signedAt(t, key, fmt.Sprintf(`{"node":{"load":%s}}`, value), ts)); err == nil {
+			t.Errorf("%s was accepted as a number", value)
+		}
+	}
+
+	if _, err := s.GetJSON(); err != nil {
+		t.Errorf("state doesn't encode: %s", err)
+	}
+}
+
+func TestRebuildVerifiesEveryMessage(t *testing.T) {
+	member, _ := crypto.GenerateKey()
+	stranger, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(member.PublicKey).String()
+
+	source := newTestState(member)
+	source.UpdateState(signedAt(t, member, `{"node":{"ip_address":"1.1.1.1"}}`, 100))
+	source.UpdateState(signedAt(t, member, `{"node":{"disk_content":["a/b"]}}`, 200))
+	source.UpdateState(signedAt(t, member, `{"node":{"disk_content":{"add":["a/c"]}}}`, 300))
+
+	stateJSON, _ := source.GetJSON()
+	sigJSON, _ := json.Marshal(map[string]interface{}{"signatures": source.GetSignatureList()})
+
+	for name, body := range map[string][]byte{"state": stateJSON, "signatures": sigJSON} {
+		sms, err := ParseSignedMessages(body)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		// A forged message and one from outside the pool
+		forged := signedAt(t, member, `{"node":{"ip_address":"6.6.6.6"}}`, 400)
+		forged.Address = crypto.PubkeyToAddress(stranger.PublicKey).String()
+		sms = append(sms, forged, signedAt(t, stranger, `{"node":{"ip_address":"6.6.6.6"}}`, 400))
+
+		s := newTestState(member)
+		result := s.Rebuild(sms)
+		if result.Accepted != 3 || len(result.Rejected) != 2 {
+			t.Errorf("%s: expected 3 accepted and 2 rejected, got %+v", name, result)
+		}
+		if list := s.GetNodeField(address, "disk_content").(*SignedList); len(list.Data) != 2 {
+			t.Errorf("%s: list wasn't rebuilt: %v", name, list.Data)
+		}
+	}
+}
+
+func TestFingerprintMatchesAcrossPeers(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	messages := []*signature.SignedMessage{
+		signedAt(t, key, `{"node":{"ip_address":"1.1.1.1","disk_content":["a/1","a/2"]}}`, 100),
+		signedAt(t, key, `{"node":{"disk_content":{"add":["a/3"]}}}`, 200),
+		signedAt(t, key, `{"delete":{"node":["ip_address"]}}`, 300),
+		signedAt(t, key, `{"node":{"disk_content":{"remove":["a/1"]}}}`, 400),
+		signedAt(t, key, `{"node":{"heartbeat":1}}`, 500),
+	}
+
+	a := newTestState(key)
+	b := newTestState(key)
+	for i := range messages {
+		a.UpdateState(messages[i])
+		b.UpdateState(messages[len(messages)-1-i])
+	}
+
+	if a.Fingerprint() != b.Fingerprint() {
+		t.Error("same messages in a different order gave different fingerprints")
+	}
+	if f := a.computeFingerprint(); a.Fingerprint() != fmt.Sprintf("%x", f[:]) {
+		t.Error("incremental fingerprint doesn't match a full recompute")
+	}
+	if newTestState(key).Fingerprint() == a.Fingerprint() {
+		t.Error("empty state has the same fingerprint")
+	}
+}
+
+func TestConcurrentUpdatesAndReads(t *testing.T) {
+	keys := make([]*ecdsa.PrivateKey, 4)
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+	}
+	s := newTestState(keys...)
+	now := time.Now().Unix()
+
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key *ecdsa.PrivateKey) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				s.UpdateState(signedAt(t, key, fmt.Sprintf(`{"node":{"heartbeat":%d,"disk_content":{"add":["f/%d"]}}}`, i, i), now))
+			}
+		}(key)
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snap := s.Snapshot()
+				for address := range snap.NodeDataMap {
+					snap.IsNodeAlive(address, time.Minute)
+				}
+				s.GetJSON()
+				s.GetDigest()
+				s.GetSignatureList()
+				s.Fingerprint()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	snap := s.Snapshot()
+	if len(snap.NodeDataMap) != len(keys) {
+		t.Fatalf("expected %d nodes, got %d", len(keys), len(snap.NodeDataMap))
+	}
+	for address := range snap.NodeDataMap {
+		if list := snap.GetNodeField(address, "disk_content").(*SignedList); len(list.Data) != 20 {
+			t.Errorf("expected 20 items for %s, got %d", address, len(list.Data))
+		}
+	}
+}
+
+func TestContentIndexFollowsDiskContent(t *testing.T) {
+	a, _ := crypto.GenerateKey()
+	b, _ := crypto.GenerateKey()
+	addressA := crypto.PubkeyToAddress(a.PublicKey).String()
+	addressB := crypto.PubkeyToAddress(b.PublicKey).String()
+	s := newTestState(a, b)
+
+	nodesWith := func(name string) map[string]bool {
+		nodes := make(map[string]bool)
+		for _, node := range s.NodesWithContent(name) {
+			nodes[node] = true
+		}
+		return nodes
+	}
+
+	s.UpdateState(signedAt(t, a, `{"node":{"disk_content":["site/1","site/2"]}}`, 100))
+	s.UpdateState(signedAt(t, b, `{"node":{"disk_content":["site/1"]}}`, 100))
+	if n := nodesWith("site/1"); len(n) != 2 || !n[addressA] || !n[addressB] {
+		t.Errorf("expected both nodes to have site/1, got %v", n)
+	}
+
+	s.UpdateState(signedAt(t, a, `{"node":{"disk_content":{"add":["site/3"],"remove":["site/1"]}}}`, 200))
+	if n := nodesWith("site/1"); len(n) != 1 || !n[addressB] {
+		t.Errorf("removed content is still indexed: %v", n)
+	}
+	if n := nodesWith("site/3"); len(n) != 1 || !n[addressA] {
+		t.Errorf("added content isn't indexed: %v", n)
+	}
+
+	s.UpdateState(signedAt(t, b, `{"delete":{"node":["disk_content"]}}`, 300))
+	if n := nodesWith("site/1"); len(n) != 0 {
+		t.Errorf("deleted content is still indexed: %v", n)
+	}
+
+	// A snapshot keeps the index it was taken with
+	snap := s.SnapshotContent([]string{"site/2"})
+	s.UpdateState(signedAt(t, a, `{"delete":{"node":["*"]}}`, 400))
+	if len(s.NodesWithContent("site/2")) != 0 || len(snap.NodesWithContent("site/2")) != 1 {
+		t.Error("deleting a node didn't update the index, or changed the snapshot")
+	}
+	if _, ok := snap.NodeDataMap[addressA]; !ok || len(snap.NodeDataMap) != 1 {
+		t.Errorf("expected the snapshot to only have the node with the content, got %d nodes", len(snap.NodeDataMap))
+	}
+
+	// A parsed state builds its index from the data
+	s.UpdateState(signedAt(t, b, `{"node":{"disk_content":["site/4"]}}`, 500))
+	b2, _ := s.GetJSON()
+	parsed, err := ParseNetworkState(b2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := parsed.NodesWithContent("site/4"); len(nodes) != 1 || nodes[0] != addressB {
+		t.Errorf("parsed state has the wrong index: %v", nodes)
+	}
+}
@@ -0,0 +1,204 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/signature"
+)
+
+// wholeNode is the field name of a tombstone that deletes an entire node
+const wholeNode = "*"
+
+// tombstoneKey identifies what a tombstone deleted, Node is empty for pool
+// fields and Field is wholeNode when the whole node was deleted
+type tombstoneKey struct {
+	Node  string
+	Field string
+}
+
+// isNewer returns true if sm should replace the value set by current
+func isNewer(sm, current *signature.SignedMessage) bool {
+	return sm.IsNewerThan(current)
+}
+
+// SetTombstoneRetention sets how long deletes are remembered. After that an
+// older update for the deleted field could be accepted again, so this should
+// be longer than any peer is expected to be offline.
+func (s *State) SetTombstoneRetention(d time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.tombstoneRetention = d
+}
+
+// ExpireTombstones forgets deletes older than the retention window and
+// returns how many were removed
+func (s *State) ExpireTombstones() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.tombstoneRetention <= 0 {
+		return 0
+	}
+
+	oldest := time.Now().Add(-s.tombstoneRetention).Unix()
+	removed := 0
+	for key, sm := range s.tombstones {
+		if sm.GetTimestamp() < oldest {
+			s.removeTombstone(key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// isTombstoned returns true if the field (or its whole node) was deleted by a
+// message at least as new as sm
+func (s *State) isTombstoned(node, field string, sm *signature.SignedMessage) bool {
+	if ts := s.tombstones[tombstoneKey{Node: node, Field: field}]; ts != nil && !isNewer(sm, ts) {
+		return true
+	}
+	if node != "" {
+		if ts := s.tombstones[tombstoneKey{Node: node, Field: wholeNode}]; ts != nil && !isNewer(sm, ts) {
+			return true
+		}
+	}
+	return false
+}
+
+// latestMessage returns the message that last set or deleted the field
+func (s *State) latestMessage(node, field string) *signature.SignedMessage {
+	if ts := s.tombstones[tombstoneKey{Node: node, Field: field}]; ts != nil {
+		return ts
+	}
+	return signedMessageOf(s.fieldOf(node, field))
+}
+
+// fieldOf returns a node field, or a pool field when node is empty
+func (s *State) fieldOf(node, field string) interface{} {
+	if node == "" {
+		return s.PoolData[field]
+	}
+	return s.NodeDataMap[node][field]
+}
+
+// deleteHandler adds the deletes in a message to the plan, they look like:
+//
+//	{"node": ["field", ...]}   deletes fields (or "*" for everything) of the signer's node
+//	{"pool": ["field", ...]}   deletes pool fields, pool manager only
+//	{"nodes": ["0x...", ...]}  deletes whole nodes, pool manager only
+func (s *State) deleteHandler(deleteUpdate []byte, sm *signature.SignedMessage, plan *updatePlan) error {
+	handler := func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		scope := string(key)
+		switch scope {
+		case "node":
+		case "pool", "nodes":
+			if !sm.IsPoolManagerAndVerified() {
+				return errors.New("Message is not verified or not from pool manager")
+			}
+		default:
+			return fmt.Errorf("Unsupported delete scope: %s", scope)
+		}
+
+		jsonparser.ArrayEach(value, func(v []byte, dt jsonparser.ValueType, offset int, err error) {
+			name := string(v)
+			resultKey := "delete." + scope + "." + name
+			fields := s.nodeDataFields
+			node := sm.Address
+			if scope == "pool" {
+				fields = s.poolDataFields
+				node = ""
+			}
+
+			if scope == "nodes" {
+				s.planNodeDelete(plan, resultKey, name, sm)
+			} else if scope == "node" && name == wholeNode {
+				s.planNodeDelete(plan, resultKey, sm.Address, sm)
+			} else if _, ok := fields[name]; ok {
+				s.planFieldDelete(plan, resultKey, node, name, sm)
+			} else {
+				plan.unknown(resultKey)
+			}
+		})
+		return nil
+	}
+	return jsonparser.ObjectEach(deleteUpdate, handler)
+}
+
+// planFieldDelete adds removing the field and leaving a tombstone to the
+// plan, so older updates for it are rejected
+func (s *State) planFieldDelete(plan *updatePlan, resultKey, node, field string, sm *signature.SignedMessage) {
+	if s.isTombstoned(node, field, sm) {
+		plan.stale(resultKey)
+		return
+	}
+
+	// A list with operations newer than the delete is emptied as of the
+	// delete, keeping those operations, the same as if they came after it
+	if list, ok := s.fieldOf(node, field).(*SignedList); ok && isNewer(sm, list.SignedMessage) && !isNewer(sm, list.latest()) {
+		ops := make([]*SignedListOp, 0)
+		for _, op := range list.Ops {
+			if op.SignedMessage.IsNewerThan(sm) {
+				ops = append(ops, op)
+			}
+		}
+		updated := newSignedList([]string{}, sm, ops)
+		plan.add(resultKey, func() {
+			s.setField(node, field, updated)
+			s.publishField(scopeOf(node), node, field, updated.Data, sm)
+		})
+		return
+	}
+
+	if !isNewer(sm, s.latestMessage(node, field)) {
+		plan.stale(resultKey)
+		return
+	}
+
+	plan.add(resultKey, func() {
+		s.removeField(node, field)
+		s.setTombstone(tombstoneKey{Node: node, Field: field}, sm)
+		s.publishDelete(node, field, sm)
+	})
+}
+
+// planNodeDelete adds removing every field of the node that is older than
+// the message, and leaving a tombstone for the whole node, to the plan
+func (s *State) planNodeDelete(plan *updatePlan, resultKey, node string, sm *signature.SignedMessage) {
+	if ts := s.tombstones[tombstoneKey{Node: node, Field: wholeNode}]; ts != nil && !isNewer(sm, ts) {
+		plan.stale(resultKey)
+		return
+	}
+
+	plan.add(resultKey, func() {
+		// Fields set after the delete was signed survive it
+		for field, value := range s.NodeDataMap[node] {
+			if !isNewer(signedMessageOf(value), sm) {
+				s.removeField(node, field)
+			}
+		}
+
+		// The node tombstone covers any older field tombstones
+		for key, ts := range s.tombstones {
+			if key.Node == node && key.Field != wholeNode && !isNewer(ts, sm) {
+				s.removeTombstone(key)
+			}
+		}
+
+		s.setTombstone(tombstoneKey{Node: node, Field: wholeNode}, sm)
+		s.publishDelete(node, "", sm)
+	})
+}
+
+func (s *State) publishDelete(node, field string, sm *signature.SignedMessage) {
+	s.publish(FieldChange{
+		Scope:     scopeOf(node),
+		Node:      node,
+		Field:     field,
+		Deleted:   true,
+		Timestamp: sm.GetTimestamp(),
+		Signer:    sm.Address,
+	})
+}
@@ -0,0 +1,111 @@
+package state
+
+import (
+	"errors"
+)
+
+// FieldOutcome is what happened to one field of an update message
+type FieldOutcome string
+
+const (
+	// FieldApplied fields were written to the state
+	FieldApplied FieldOutcome = "applied"
+	// FieldStale fields were skipped because we already have a newer version
+	FieldStale FieldOutcome = "stale"
+	// FieldUnknown fields aren't registered here and were skipped, the rest of
+	// the message is still applied so new fields can be rolled out to peers
+	// one at a time
+	FieldUnknown FieldOutcome = "unknown"
+	// FieldInvalid fields have a value the schema doesn't allow, the message is
+	// rejected
+	FieldInvalid FieldOutcome = "invalid"
+	// FieldSkipped fields were valid but another field rejected the message
+	FieldSkipped FieldOutcome = "skipped"
+)
+
+// ErrStale is returned for messages where every field we know about has
+// already been replaced by something newer, including messages we already
+// have. Unlike other rejections this doesn't depend on when the message
+// arrives.
+var ErrStale = errors.New("Message was older than the current version")
+
+// UpdateResult is the outcome of every field in an update message, keyed by
+// the field's path in the message like "node.ip_address" or
+// "delete.node.disk_content"
+type UpdateResult struct {
+	Applied bool                    `json:"applied"`
+	Fields  map[string]FieldOutcome `json:"fields"`
+}
+
+// updatePlan collects the changes a message makes so every field can be
+// checked before any of them are applied
+type updatePlan struct {
+	result  *UpdateResult
+	changes []func()
+	err     error
+}
+
+func newUpdatePlan() *updatePlan {
+	return &updatePlan{result: &UpdateResult{Fields: make(map[string]FieldOutcome)}}
+}
+
+// add records a field that will be applied along with the rest of the message
+func (p *updatePlan) add(key string, change func()) {
+	p.result.Fields[key] = FieldApplied
+	p.changes = append(p.changes, change)
+}
+
+// stale records a field that is skipped because we have a newer version
+func (p *updatePlan) stale(key string) {
+	p.result.Fields[key] = FieldStale
+}
+
+// unknown records a field that is skipped because it isn't registered
+func (p *updatePlan) unknown(key string) {
+	p.result.Fields[key] = FieldUnknown
+}
+
+// reject records a field that stops the whole message from being applied,
+// the first rejection's error is returned
+func (p *updatePlan) reject(key string, outcome FieldOutcome, err error) {
+	p.result.Fields[key] = outcome
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// check returns an error if the message shouldn't be applied
+func (p *updatePlan) check() error {
+	if p.err != nil {
+		return p.err
+	}
+	if len(p.changes) == 0 {
+		for _, outcome := range p.result.Fields {
+			if outcome == FieldStale {
+				return ErrStale
+			}
+		}
+		if len(p.result.Fields) > 0 {
+			return errors.New("Unsupported field in update message")
+		}
+		return errors.New("Nothing was updated")
+	}
+	return nil
+}
+
+// skipAll marks the fields that would have been applied as skipped
+func (p *updatePlan) skipAll() {
+	for key, outcome := range p.result.Fields {
+		if outcome == FieldApplied {
+			p.result.Fields[key] = FieldSkipped
+		}
+	}
+}
+
+// apply makes every change in the plan, the state lock must be held
+func (p *updatePlan) apply() {
+	for _, change := range p.changes {
+		change()
+	}
+	p.result.Applied = true
+}
@@ -11,8 +11,8 @@ import (
 
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/gladiusio/gladius-common/pkg/blockchain"
-	"github.com/gladiusio/gladius-p2p/pkg/p2p/message"
-	"github.com/gladiusio/gladius-p2p/pkg/p2p/peer"
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/message"
+	"github.com/gladiusio/gladius-network-gateway/pkg/p2p/peer"
 	"github.com/spf13/viper"
 )
 
@@ -92,9 +92,9 @@ func killPeers(peers []*peer.Peer) {
 func buildNetwork(peers []*peer.Peer, t *testing.T) {
 	// Let the first node be a seed node
 	for i := 1; i < numOfPeers; i++ {
-		err := peers[i].Join([]string{fmt.Sprintf("kcp://127.0.0.1:%d", 7946)})
+		result, err := peers[i].Join([]string{fmt.Sprintf("kcp://127.0.0.1:%d", 7946)})
 		if err != nil {
-			t.Errorf("node %d couldn't join network: error was: %s", i, err.Error())
+			t.Errorf("node %d couldn't join network: error was: %s, seeds: %+v", i, err.Error(), result)
 		}
 	}
 }
@@ -111,7 +111,7 @@ func signTestMessage(peers []*peer.Peer, t *testing.T) {
 			t.Fail()
 		}
 
-		err = peers[i].UpdateAndPushState(sm)
+		_, err = peers[i].UpdateAndPushState(sm)
 		if err != nil {
 			t.Errorf("node %d couldn't update state: error was: %s", i, err.Error())
 			t.Fail()